@@ -8,19 +8,96 @@ import (
 )
 
 type serverConf struct {
-	Server  nodeConf    `yaml:"server"`
-	Log     logConf     `yaml:"log"`
-	Proxies []proxyConf `yaml:"proxies"`
+	Server          nodeConf             `yaml:"server"`
+	Crypto          cryptoConf           `yaml:"crypto"`
+	Log             logConf              `yaml:"log"`
+	Proxies         []proxyConf          `yaml:"proxies"`
+	TCPForwards     []tcpForwardConf     `yaml:"tcp_forwards"`
+	ReverseForwards []reverseForwardConf `yaml:"reverse_forwards"`
 }
 
 type nodeConf struct {
-	SelfAddr string `yaml:"self_addr"`
-	PeerAddr string `yaml:"peer_addr"`
+	Name           string   `yaml:"name"`  // name presented to peers when login, hostname if empty
+	Token          string   `yaml:"token"` // token presented to peers when login, and required from peers if not empty
+	SelfAddr       string   `yaml:"self_addr"`
+	PeerAddr       string   `yaml:"peer_addr"`
+	PoolSize       int      `yaml:"pool_size"`        // number of parallel connections to peer_addr, default 1
+	Balance        string   `yaml:"balance"`          // round_robin(default) or least_inflight
+	Timeout        int      `yaml:"timeout"`          // default request timeout(seconds), overridden by HTTP header "X-Bifrost-Timeout"
+	Codecs         []string `yaml:"codecs"`           // compression codecs in order of preference: gzip, zlib, deflate or none
+	Routes         []string `yaml:"routes"`           // hosts reachable through this node announced to peers, e.g.: "10.0.0.1:8080"
+	AcceptRoutes   []string `yaml:"accept_routes"`    // hosts peers may announce as routes, none if empty
+	Drain          int      `yaml:"drain"`            // seconds to wait for pending requests when shutting down, default 30
+	MaxMessageSize int      `yaml:"max_message_size"` // maximum websocket message size(bytes) allowed from peers, default 65536
+	Flow           flowConf `yaml:"flow"`
+	TLS            tlsConf  `yaml:"tls"`
+
+	// ports peers may ask this node to listen on by reverse_forwards, keyed by
+	// the common name or subject of the peer's verified client certificate, or
+	// "*" for any peer, e.g.: dc-west: ["2222", "8000-8100"]
+	ReversePorts map[string][]string `yaml:"reverse_ports"`
+	// targets peers may ask this node to dial by tcp_forwards or CONNECT,
+	// keyed like reverse_ports, either "host:port" or a host for any port
+	TCPTargets map[string][]string `yaml:"tcp_targets"`
+}
+
+// flowConf bounds the requests handled at the same time, to apply
+// backpressure when the tunnel is saturated.
+type flowConf struct {
+	Workers     int    `yaml:"workers"`      // maximum requests from peers handled at the same time, default 256
+	MaxInflight int    `yaml:"max_inflight"` // maximum requests sent to peers waiting for response, default 1024
+	Saturation  string `yaml:"saturation"`   // policy when saturated: block(default), shed or queue
+	QueueLimit  int    `yaml:"queue_limit"`  // maximum requests waiting by the queue policy, more are shed; 256 if 0
+}
+
+// tlsConf configures WebSocket Secure (wss) for both the listening side and
+// the dialing side.
+type tlsConf struct {
+	CertFile   string `yaml:"cert_file"`   // certificate served by the listener, also presented as client cert when dialing
+	KeyFile    string `yaml:"key_file"`    // private key of cert_file
+	CAFile     string `yaml:"ca_file"`     // CA bundle to verify the peer when dialing, system pool if empty
+	ServerName string `yaml:"server_name"` // override the server name verified when dialing
+
+	// mutual TLS: peers connecting to /ws must present a certificate signed
+	// by client_ca_file, and its subject must be in allowed_peers if not empty.
+	ClientCAFile string   `yaml:"client_ca_file"`
+	AllowedPeers []string `yaml:"allowed_peers"` // common names or full subjects, e.g.: "CN=dc-east,O=bifrost"
+}
+
+type cryptoConf struct {
+	Cipher    string    `yaml:"cipher"`     // aes-256-gcm(default) or chacha20-poly1305
+	ActiveKey uint8     `yaml:"active_key"` // ID of the key to encrypt, the first key if not set
+	Keys      []keyConf `yaml:"keys"`       // keys to decrypt, peers must share the active key
+}
+
+// keyConf is a hex encoded key generated by `bifrost keygen`, which is read
+// from the first non-empty one of key, key_env and key_file.
+type keyConf struct {
+	ID   uint8  `yaml:"id"`       // 1-255, carried in packets to select the key to decrypt
+	Key  string `yaml:"key"`      // hex encoded key
+	Env  string `yaml:"key_env"`  // environment variable of the hex encoded key
+	File string `yaml:"key_file"` // file of the hex encoded key
 }
 
 type proxyConf struct {
 	Path   string `yaml:"path"`
 	Target string `yaml:"target"`
+	Peer   string `yaml:"peer"` // name of the peer to go through, any peer if empty
+}
+
+// tcpForwardConf forwards TCP connections accepted on listen to target dialed
+// by the peer.
+type tcpForwardConf struct {
+	Listen string `yaml:"listen"` // e.g.: ":15432"
+	Target string `yaml:"target"` // host:port dialed by the peer, e.g.: "db.internal:5432"
+	Peer   string `yaml:"peer"`   // name of the peer to go through, any peer if empty
+}
+
+// reverseForwardConf asks the peer to listen on remote, and forwards the
+// connections accepted to target dialed by this node.
+type reverseForwardConf struct {
+	Remote string `yaml:"remote"` // address listened on by the peer, e.g.: ":2222"
+	Target string `yaml:"target"` // host:port dialed by this node, e.g.: "127.0.0.1:22"
 }
 
 type logConf struct {
@@ -40,6 +117,5 @@ func InitConf(path string) error {
 	if err != nil {
 		panic(err)
 	}
-	fmt.Printf("conf: %+v\n", Conf)
 	return nil
 }
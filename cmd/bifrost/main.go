@@ -2,13 +2,19 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
 	"regexp"
+	"syscall"
+	"time"
 
 	"github.com/Wenchy/bifrost/cmd/bifrost/conf"
 	"github.com/Wenchy/bifrost/cmd/bifrost/ws"
@@ -16,6 +22,16 @@ import (
 )
 
 func main() {
+	// subcommand: bifrost keygen
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		key, err := ws.GenKey()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(key)
+		return
+	}
+
 	confpath := flag.String("conf", "conf.yaml", "config file path.")
 	flag.Parse()
 	conf.InitConf(*confpath) // server config
@@ -23,10 +39,59 @@ func main() {
 	atom.InitZap(conf.Conf.Log.Level, conf.Conf.Log.Dir) // log
 	defer atom.Log.Sync()
 
+	name := conf.Conf.Server.Name
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	ws.SetIdentity(name, conf.Conf.Server.Token)
+	if err := ws.SetCipher(conf.Conf.Crypto.Cipher); err != nil {
+		panic(err)
+	}
+	if err := ws.SetCodecs(conf.Conf.Server.Codecs); err != nil {
+		panic(err)
+	}
+	if err := initKeyring(); err != nil {
+		panic(err)
+	}
+	if conf.Conf.Server.Timeout > 0 {
+		ws.SetRequestTimeout(time.Duration(conf.Conf.Server.Timeout) * time.Second)
+	}
+	if err := ws.Hub.SetBalance(conf.Conf.Server.Balance); err != nil {
+		panic(err)
+	}
+	ws.SetRoutes(conf.Conf.Server.Routes)
+	ws.SetAcceptRoutes(conf.Conf.Server.AcceptRoutes)
+	if err := ws.SetMaxMessageSize(conf.Conf.Server.MaxMessageSize); err != nil {
+		panic(err)
+	}
+	flow := conf.Conf.Server.Flow
+	if err := ws.SetFlowControl(flow.Workers, flow.MaxInflight, flow.Saturation, flow.QueueLimit); err != nil {
+		panic(err)
+	}
+	if err := ws.SetReversePorts(conf.Conf.Server.ReversePorts); err != nil {
+		panic(err)
+	}
+	ws.SetTCPTargets(conf.Conf.Server.TCPTargets)
+	reverseForwards := map[string]string{}
+	for _, fwd := range conf.Conf.ReverseForwards {
+		reverseForwards[fwd.Remote] = fwd.Target
+	}
+	ws.SetReverseForwards(reverseForwards)
 	go ws.Hub.Run()
+	go drainOnSignal()
 
+	tlsConf := conf.Conf.Server.TLS
 	if conf.Conf.Server.PeerAddr != "" {
-		ws.BuildNewTunnel(conf.Conf.Server.PeerAddr)
+		dialTLSConf, err := ws.NewDialTLSConfig(tlsConf.CertFile, tlsConf.KeyFile, tlsConf.CAFile, tlsConf.ServerName)
+		if err != nil {
+			panic(err)
+		}
+		ws.BuildNewTunnel(conf.Conf.Server.PeerAddr, conf.Conf.Server.PoolSize, dialTLSConf)
+	}
+	for _, fwd := range conf.Conf.TCPForwards {
+		if _, err := ws.ForwardTCP(fwd.Listen, fwd.Target, fwd.Peer); err != nil {
+			panic(err)
+		}
 	}
 
 	// start server
@@ -35,46 +100,138 @@ func main() {
 		ws.ServeWS(rw, req)
 	})
 
-	if err := http.ListenAndServe(conf.Conf.Server.SelfAddr, nil); err != nil {
+	if tlsConf.CertFile == "" {
+		if err := http.ListenAndServe(conf.Conf.Server.SelfAddr, handleConnect(http.DefaultServeMux)); err != nil {
+			panic(err)
+		}
+		return
+	}
+	// serve wss
+	serverTLSConf, err := ws.NewServerTLSConfig(tlsConf.CertFile, tlsConf.KeyFile, tlsConf.ClientCAFile)
+	if err != nil {
 		panic(err)
 	}
+	if tlsConf.ClientCAFile != "" {
+		ws.RequirePeerCert(tlsConf.AllowedPeers)
+	}
+	server := &http.Server{
+		Addr:      conf.Conf.Server.SelfAddr,
+		Handler:   handleConnect(http.DefaultServeMux),
+		TLSConfig: serverTLSConf,
+	}
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		panic(err)
+	}
+}
+
+// drainOnSignal tells peers to send no more requests when terminated, and
+// exits after pending requests are finished.
+func drainOnSignal() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	timeout := 30 * time.Second
+	if conf.Conf.Server.Drain > 0 {
+		timeout = time.Duration(conf.Conf.Server.Drain) * time.Second
+	}
+	atom.Log.Infof("%v received, draining", sig)
+	ws.Hub.Drain(timeout)
+	atom.Log.Sync()
+	os.Exit(0)
+}
+
+// initKeyring loads the keys to encrypt the tunnel from conf.
+func initKeyring() error {
+	cryptoConf := conf.Conf.Crypto
+	if len(cryptoConf.Keys) == 0 {
+		return errors.New("no crypto key configured, generate one by: bifrost keygen")
+	}
+	active := cryptoConf.ActiveKey
+	if active == 0 {
+		active = cryptoConf.Keys[0].ID
+	}
+	kr := ws.NewKeyring(active)
+	found := false
+	for _, k := range cryptoConf.Keys {
+		if k.ID == 0 {
+			return errors.New("crypto key ID must be 1-255")
+		}
+		if k.Key == "" && k.Env == "" && k.File == "" {
+			return fmt.Errorf("crypto key %d is empty, generate one by: bifrost keygen", k.ID)
+		}
+		found = found || k.ID == active
+		key, err := ws.LoadKey(k.Key, k.Env, k.File)
+		if err != nil {
+			return fmt.Errorf("load crypto key %d failed: %v", k.ID, err)
+		}
+		if err := kr.Add(k.ID, key); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("active crypto key %d not found in keys", active)
+	}
+	ws.SetKeyring(kr)
+	return nil
 }
 
-func findTarget(req *http.Request) string {
+// findTarget returns the target and the name of the peer to go through.
+func findTarget(req *http.Request) (string, string) {
+	// HTTP header field "X-Bifrost-Peer" overrides the peer in conf
+	peer := req.Header.Get("X-Bifrost-Peer")
+	req.Header.Del("X-Bifrost-Peer")
 
 	// step-1: judge by HTTP header field "X-Bifrost-Target"
 	target := req.Header.Get("X-Bifrost-Target")
 	if target != "" {
-		return target
+		return target, peer
 	}
 	// step-2: judge by conf
 	for _, proxy := range conf.Conf.Proxies {
 		matched, err := regexp.MatchString(proxy.Path, req.URL.Path)
 		if err != nil {
 			atom.Log.Errorf("path: %v, MatchString failed: %v", proxy.Path, err)
-			return ""
+			return "", ""
 		}
 		if matched {
-			return proxy.Target
+			if peer == "" {
+				peer = proxy.Peer
+			}
+			return proxy.Target, peer
 		}
 	}
-	return ""
+	return "", ""
 }
 
 // Given a request send it to the appropriate url
 func handleRequestAndRedirect(rw http.ResponseWriter, req *http.Request) {
 	// requestPayload := getRequestBodyCopy(req)
-	target := findTarget(req)
+	target, peer := findTarget(req)
 	if target == "" {
 		atom.Log.Errorf("target not found of path: %s", req.URL.Path)
 		return
 	}
-	logRequestPayload(req, target)
+	logRequestPayload(req, target, peer)
 
-	ws.Forward(target, rw, req)
+	ws.Forward(target, peer, rw, req)
 	// serveReverseProxy(proxyTargetUrl, rw, req)
 }
 
+// handleConnect tunnels requests of method CONNECT through the peer, which
+// are not routed by path, and serves others by next.
+func handleConnect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		// HTTP header field "X-Bifrost-Peer" names the peer as well
+		peer := req.Header.Get("X-Bifrost-Peer")
+		atom.Log.Infof("connect: %s, peer: %s, from: %s", req.Host, peer, req.RemoteAddr)
+		ws.Connect(peer, rw, req)
+	})
+}
+
 // Serve a reverse proxy for a given url
 func serveReverseProxy(target string, rw http.ResponseWriter, req *http.Request) {
 	// parse the url
@@ -110,6 +267,6 @@ func getRequestBodyCopy(request *http.Request) io.ReadCloser {
 }
 
 // Log the typeform payload and redirect url
-func logRequestPayload(req *http.Request, target string) {
-	atom.Log.Infof("target: %s, from: %s\n", target, req.URL.String())
+func logRequestPayload(req *http.Request, target, peer string) {
+	atom.Log.Infof("target: %s, peer: %s, from: %s\n", target, peer, req.URL.String())
 }
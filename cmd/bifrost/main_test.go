@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Wenchy/bifrost/cmd/bifrost/conf"
+	"github.com/Wenchy/bifrost/internal/atom"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	atom.Log = zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+// initTestConf loads the proxies of conf from yaml.
+func initTestConf(t *testing.T, yaml string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "conf.yaml")
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := conf.InitConf(path); err != nil {
+		t.Fatalf("InitConf() error = %v", err)
+	}
+}
+
+func TestFindTarget(t *testing.T) {
+	initTestConf(t, `
+proxies:
+  - path: ^/east/
+    target: http://east.internal
+    peer: dc-east
+  - path: ^/
+    target: http://any.internal
+`)
+	for _, tt := range []struct {
+		name       string
+		path       string
+		header     map[string]string
+		wantTarget string
+		wantPeer   string
+	}{
+		{name: "peer of proxy", path: "/east/api", wantTarget: "http://east.internal", wantPeer: "dc-east"},
+		{name: "any peer", path: "/api", wantTarget: "http://any.internal"},
+		{name: "header overrides proxy", path: "/east/api", header: map[string]string{"X-Bifrost-Peer": "dc-west"}, wantTarget: "http://east.internal", wantPeer: "dc-west"},
+		{name: "header names peer", path: "/api", header: map[string]string{"X-Bifrost-Peer": "dc-west"}, wantTarget: "http://any.internal", wantPeer: "dc-west"},
+		{name: "target by header", path: "/east/api", header: map[string]string{"X-Bifrost-Target": "http://other", "X-Bifrost-Peer": "dc-west"}, wantTarget: "http://other", wantPeer: "dc-west"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			target, peer := findTarget(req)
+			if target != tt.wantTarget || peer != tt.wantPeer {
+				t.Errorf("findTarget() = %q, %q, want %q, %q", target, peer, tt.wantTarget, tt.wantPeer)
+			}
+			// not sent to the peer
+			if req.Header.Get("X-Bifrost-Peer") != "" {
+				t.Errorf("X-Bifrost-Peer not removed")
+			}
+		})
+	}
+}
+
+func TestOfflinePeer(t *testing.T) {
+	initTestConf(t, `
+proxies:
+  - path: ^/
+    target: http://any.internal
+    peer: dc-east
+crypto:
+  keys:
+    - id: 1
+      key: 904F4BD34C303D2A2F5C609D3DEF710FEEBDE497DF4840380927D744D343D4CD
+`)
+	if err := initKeyring(); err != nil {
+		t.Fatalf("initKeyring() error = %v", err)
+	}
+	for _, tt := range []struct {
+		name   string
+		header string // X-Bifrost-Peer
+	}{
+		{name: "peer of proxy"},
+		{name: "peer by header", header: "dc-west"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api", nil)
+			if tt.header != "" {
+				req.Header.Set("X-Bifrost-Peer", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handleRequestAndRedirect(rec, req)
+			if got := rec.Header().Get("X-Bifrost-Error"); rec.Code != http.StatusBadGateway || got != "peer_offline" {
+				t.Errorf("status = %d %s, want %d peer_offline", rec.Code, got, http.StatusBadGateway)
+			}
+		})
+	}
+}
+
+func TestInitKeyring(t *testing.T) {
+	const hexKey = "904F4BD34C303D2A2F5C609D3DEF710FEEBDE497DF4840380927D744D343D4CD"
+	file := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(file, []byte(hexKey+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	os.Setenv("BIFROST_TEST_KEY", hexKey)
+	defer os.Unsetenv("BIFROST_TEST_KEY")
+	os.Unsetenv("BIFROST_TEST_EMPTY")
+
+	for _, tt := range []struct {
+		name    string
+		active  int
+		keys    string // yaml of crypto.keys
+		wantErr bool
+	}{
+		{name: "literal", keys: "{id: 1, key: " + hexKey + "}"},
+		{name: "env", keys: "{id: 1, key_env: BIFROST_TEST_KEY}"},
+		{name: "file", keys: "{id: 1, key_file: " + file + "}"},
+		{name: "active key", active: 2, keys: "{id: 1, key: " + hexKey + "}, {id: 2, key_env: BIFROST_TEST_KEY}"},
+		{name: "no keys", keys: "", wantErr: true},
+		{name: "empty key", keys: "{id: 1}", wantErr: true},
+		{name: "key ID 0", keys: "{id: 0, key: " + hexKey + "}", wantErr: true},
+		{name: "active key not found", active: 2, keys: "{id: 1, key: " + hexKey + "}", wantErr: true},
+		{name: "duplicate key ID", keys: "{id: 1, key: " + hexKey + "}, {id: 1, key_file: " + file + "}", wantErr: true},
+		{name: "short key", keys: "{id: 1, key: 904F4BD3}", wantErr: true},
+		{name: "empty env", keys: "{id: 1, key_env: BIFROST_TEST_EMPTY}", wantErr: true},
+		{name: "file not found", keys: "{id: 1, key_file: " + file + ".missing}", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			initTestConf(t, fmt.Sprintf("crypto: {active_key: %d, keys: [%s]}\n", tt.active, tt.keys))
+			if err := initKeyring(); (err != nil) != tt.wantErr {
+				t.Errorf("initKeyring() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
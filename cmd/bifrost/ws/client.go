@@ -1,9 +1,20 @@
 package ws
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Wenchy/bifrost/internal/atom"
@@ -21,8 +32,9 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size(64k) allowed from peer.
-	maxMessageSize = 64 * 1024
+	// Maximum bytes of queued packets batched into one websocket message,
+	// which is also limited by the message limit of peer.
+	maxBatchSize = 64 * 1024
 )
 
 var upgrader = websocket.Upgrader{
@@ -30,10 +42,46 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
+// Responser writes the response streamed from the peer back to the request.
 type Responser struct {
-	done chan bool // indicate if http response is recieved
-	req  *http.Request
-	rw   http.ResponseWriter
+	pipe        *packetPipe // response packets of the request
+	req         *http.Request
+	rw          http.ResponseWriter
+	wroteHeader bool // whether the response header is written to rw
+}
+
+// inbound is a request received from the peer, which is being handled.
+type inbound struct {
+	body    *bodyReader
+	ctx     context.Context
+	cancel  context.CancelFunc // cancel the request when the peer asks to
+	waiting int32              // 1 until a worker is taken, accessed atomically
+}
+
+func newInbound(c *Client, seq uint32) *inbound {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &inbound{
+		body:    newBodyReader(newPacketPipe(c.pipeLimit()), c, packet.PacketTypeRequestBody, seq, ctx.Done),
+		ctx:     ctx,
+		cancel:  cancel,
+		waiting: 1,
+	}
+}
+
+// push delivers a packet of the request body, see bodyReader.pushWaiting.
+func (in *inbound) push(pkt *packet.Packet) bool {
+	if atomic.LoadInt32(&in.waiting) == 1 {
+		return in.body.pushWaiting(pkt)
+	}
+	return in.body.pipe.push(pkt)
+}
+
+func newResponser(c *Client, req *http.Request, rw http.ResponseWriter) *Responser {
+	return &Responser{
+		pipe: newPacketPipe(c.pipeLimit()),
+		req:  req,
+		rw:   rw,
+	}
 }
 
 // Messager is messager for client and msg pair.
@@ -42,105 +90,302 @@ type Messager struct {
 	msg    []byte
 }
 
+// errConnClosed is returned when the connection of a client is closed.
+var errConnClosed = errors.New("connection closed")
+
+// errSeqInUse is returned when the seq of a request sent or received is still
+// used by another request.
+var errSeqInUse = errors.New("seq in use")
+
+// errSendQueueFull is returned by trySend if the send queue is full.
+var errSendQueueFull = errors.New("send queue full")
+
+// last generated client ID. The high 32 bits are random, so that IDs assigned
+// by different bifrosts hardly collide in a hub which both dials and accepts.
+var lastClientID uint64
+
+func init() {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	lastClientID = uint64(binary.BigEndian.Uint32(b[:])) << 32
+}
+
+// genClientID generates a new unique client ID.
+func genClientID() uint64 {
+	return atomic.AddUint64(&lastClientID, 1)
+}
+
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
 	sync.RWMutex
-	// client ID
+	// client ID, assigned by the accepting side when login
 	ID uint64
+	// name of the peer presented when login
+	Name string
+	// Subject of the peer's verified TLS certificate, empty if not verified.
+	Subject string
+	// CommonName of Subject, empty if not verified.
+	CommonName string
+	// instance ID of the peer presented when login, see instanceID
+	instance string
+	// capabilities of the peer advertised when login, fixed after
+	Capabilities packet.Capability
 	// The websocket connection.
 	conn *websocket.Conn
-	// Buffered channel of outbound messages.
-	sendCh       chan []byte
-	sendChClosed bool
+	// Buffered channel of outbound frames, which is closed under sendMu.
+	sendMu sync.RWMutex
+	sendCh chan *frame
+	// 1 if the connection is closed, accessed atomically
+	closed int32
+	// closed when the connection is closed, to wake up blocked senders
+	done chan struct{}
+	// last seq allocated to requests sent, accessed atomically
+	seq uint32
 	// packet seq -> Responser
 	responsers map[uint32]*Responser
-
-	// server addr
+	// packet seq -> inbound request
+	requests map[uint32]*inbound
+	// number of requests sent and waiting for response, accessed atomically
+	inflight int32
+	// round trip time(ns) measured by ping notices, accessed atomically
+	latency int64
+	// 1 if either side is shutting down and no more requests should be sent,
+	// accessed atomically
+	draining int32
+	// hosts reachable through the peer announced by notice
+	routes []string
+	// maximum message size allowed by the peer, exchanged when login
+	peerMaxMessageSize int
+	// fragments being reassembled, only accessed by the dispatching goroutine
+	// once created, as each connection has its own client
+	fragments     map[streamKey][]byte
+	fragmentBytes int
+	// session of the connection set up when login, to encrypt packets sent
+	// and decrypt packets received
+	session *session
+	// credit to send body chunks of the connection, and of each body stream
+	connCredit *credit
+	credits    map[streamKey]*credit
+	// multiplexed streams by ID, see OpenStream
+	streams map[uint32]*Stream
+	// last ID allocated to streams opened, accessed atomically. IDs are odd
+	// on the dialing side and even on the accepting side.
+	streamID uint32
+	// frames of streams waiting to be written in turn
+	sched *scheduler
+
+	// server addr dialed, empty on the accepting side
 	addr string
 }
 
-func BuildNewTunnel(addr string) {
-	c := NewClient(addr)
-	if err := c.Dial(); err == nil {
-		c.Run()
+// Interval to dial again after a connection of the tunnel is closed or
+// failed to dial.
+const redialPeriod = 1 * time.Second
+
+// BuildNewTunnel dials poolSize parallel connections to addr and keeps them
+// connected. The tlsConf is only used when addr is a wss:// URL, nil means the
+// default TLS config.
+func BuildNewTunnel(addr string, poolSize int, tlsConf *tls.Config) {
+	dialer := newDialer(tlsConf)
+	for _, c := range dialPool(addr, poolSize, dialer) {
+		go keepConnected(addr, dialer, c)
+	}
+}
+
+// dialPool dials poolSize clients to addr, 1 if not positive. The clients
+// failed to dial are returned as nil, to be dialed again.
+func dialPool(addr string, poolSize int, dialer *websocket.Dialer) []*Client {
+	if poolSize <= 0 {
+		poolSize = 1
+	}
+	pool := make([]*Client, poolSize)
+	for i := range pool {
+		c, err := dial(addr, dialer)
+		if err == nil {
+			c.Run()
+		}
+		pool[i] = c
+	}
+	return pool
+}
+
+// keepConnected waits until the connection of c is closed, and then dials
+// addr again until connected. c is nil if not connected yet. A new client is
+// created for each connection, so that the goroutines of a closed connection
+// never race with the next one.
+func keepConnected(addr string, dialer *websocket.Dialer, c *Client) {
+	for {
+		if c != nil {
+			<-c.done
+		}
+		time.Sleep(redialPeriod)
+		var err error
+		if c, err = dial(addr, dialer); err == nil {
+			c.Run()
+		}
 	}
-	go c.autoReconnect()
 }
 
-func NewClient(addr string) *Client {
-	return &Client{
-		ID:           0,
-		conn:         nil,
-		sendCh:       nil,
-		sendChClosed: true,
-		responsers:   map[uint32]*Responser{},
-		addr:         addr,
+// newClient returns the client of the websocket conn, which is dialed to the
+// server addr, or accepted if addr is empty. A client lives as long as its
+// connection.
+func newClient(conn *websocket.Conn, addr string) *Client {
+	c := &Client{
+		conn:       conn,
+		sendCh:     make(chan *frame, 256),
+		done:       make(chan struct{}),
+		responsers: map[uint32]*Responser{},
+		requests:   map[uint32]*inbound{},
+		fragments:  map[streamKey][]byte{},
+		connCredit: newCredit(connWindow),
+		credits:    map[streamKey]*credit{},
+		streams:    map[uint32]*Stream{},
+		sched:      newScheduler(),
+		addr:       addr,
 	}
+	if addr != "" {
+		// streams opened by the dialing side have odd IDs
+		c.streamID = 1
+	}
+	return c
+}
+
+// Dial connects to the server addr, and returns the client of the connection
+// once logged in. The tlsConf is only used when addr is a wss:// URL, nil
+// means the default TLS config.
+func Dial(addr string, tlsConf *tls.Config) (*Client, error) {
+	return dial(addr, newDialer(tlsConf))
+}
+
+func newDialer(tlsConf *tls.Config) *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConf
+	return &dialer
 }
 
-func (c *Client) Dial() error {
-	conn, rsp, err := websocket.DefaultDialer.Dial(c.addr, nil)
+func dial(addr string, dialer *websocket.Dialer) (*Client, error) {
+	header := http.Header{versionHeader: {strconv.Itoa(int(packet.Version))}}
+	conn, rsp, err := dialer.Dial(addr, header)
 	if err != nil {
+		if rsp != nil && rsp.StatusCode == http.StatusUpgradeRequired {
+			reason, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 512))
+			err = fmt.Errorf("rejected by peer: %s", bytes.TrimSpace(reason))
+		}
 		atom.Log.Errorf("websocket dial failed: %v", err)
-		return err
+		return nil, err
 	}
 	rawrsp, err := httputil.DumpResponse(rsp, true)
 	if err != nil {
 		atom.Log.Warnf("http DumpResponse failed: %v", err)
 	}
 	atom.Log.Debugf("websocket dial rsp: %v", string(rawrsp))
-
-	// below must be updated
-	c.conn = conn
-	c.sendCh = make(chan []byte, 256)
-	c.sendChClosed = false
-
-	return nil
+	if err := checkPeerVersion(rsp.Header); err != nil {
+		atom.Log.Errorf("websocket dial failed: %v", err)
+		rejectConn(conn, err)
+		return nil, err
+	}
+	// When a new client dials, ID is 0. After successfully login, response packet will give the client's ID.
+	c := newClient(conn, addr)
+	if tlsConn, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+		certs := tlsConn.ConnectionState().PeerCertificates
+		if len(certs) != 0 {
+			c.Subject = certs[0].Subject.String()
+			c.CommonName = certs[0].Subject.CommonName
+		}
+	}
+	if err := c.login(conn); err != nil {
+		atom.Log.Errorf("websocket login failed: %v", err)
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
 }
 
 func (c *Client) Run() {
+	// registered before pumping, so that the client is always unregistered
+	// by the pumps once the connection is closed
+	Hub.register(c)
+
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
 	go c.writePump()
 	go c.readPump()
-
-	Hub.register(c)
+	go c.announce()
 }
 
-func (c *Client) autoReconnect() {
-	statTicker := time.NewTicker(1 * time.Second)
-	defer func() {
-		statTicker.Stop()
-	}()
-
+// nextSeq allocates a seq to a request sent on the connection. Seq 0 is
+// reserved for packets not belonging to any request, and skipped when the
+// seq wraps around.
+func (c *Client) nextSeq() uint32 {
 	for {
-		select {
-		case <-statTicker.C:
-			connected := true
-			if c.conn == nil || c.sendChClosed {
-				connected = false
-			}
-
-			if !connected {
-				if err := c.Dial(); err == nil {
-					c.Run()
-				}
-			}
+		if seq := atomic.AddUint32(&c.seq, 1); seq != 0 {
+			return seq
 		}
 	}
 }
 
+// SendPacket sends pkt to the peer as is, which is split into fragments if
+// larger than the message limit. Its payload must have been sealed, as the
+// peer rejects packets not encrypted after login. If rsper is not nil, it will receive the
+// response packets of the same seq, and errSeqInUse is returned if the seq is
+// still used by another request after wraparound.
 func (c *Client) SendPacket(pkt *packet.Packet, rsper *Responser) error {
-	buf, err := packet.Encode(pkt)
+	return c.sendFrame(&frame{pkt: pkt}, rsper)
+}
+
+// sendSealed sends pkt with raw sealed as its payload by the session, which
+// is compressed only if compress is true.
+func (c *Client) sendSealed(pkt *packet.Packet, raw []byte, compress bool) error {
+	f, err := c.session.frame(pkt, raw, compress)
 	if err != nil {
 		return err
 	}
-	c.Lock()
-	c.responsers[pkt.Header.Seq] = rsper
-	c.Unlock()
+	return c.sendFrame(f, nil)
+}
+
+// sendFrame queues f to be written like SendPacket.
+func (c *Client) sendFrame(f *frame, rsper *Responser) error {
+	if rsper != nil {
+		seq := f.pkt.Header.Seq
+		c.Lock()
+		if atomic.LoadInt32(&c.closed) == 1 {
+			c.Unlock()
+			return errConnClosed
+		}
+		if _, ok := c.responsers[seq]; ok {
+			c.Unlock()
+			atom.Log.Warnf("%v|%d|seq collision", c.ID, seq)
+			return errSeqInUse
+		}
+		c.responsers[seq] = rsper
+		c.Unlock()
+	}
+	return c.send(f)
+}
 
-	c.send(buf)
-	return nil
+// encode seals f if needed and encodes it as messages to be written, which
+// are split into fragments if larger than the message limit. It is only
+// called by writePump, so that payloads are sealed in the order written.
+func (c *Client) encode(f *frame) ([][]byte, error) {
+	pkt := f.pkt
+	if f.sealed {
+		if err := c.session.seal(f); err != nil {
+			return nil, err
+		}
+	}
+	pkt.Header.ID = c.ID
+	frags := fragment(pkt, c.messageLimit())
+	bufs := make([][]byte, len(frags))
+	for i, frag := range frags {
+		buf, err := packet.Encode(frag)
+		if err != nil {
+			return nil, err
+		}
+		bufs[i] = buf
+	}
+	return bufs, nil
 }
 
 func (c *Client) getResponser(seq uint32) *Responser {
@@ -150,6 +395,41 @@ func (c *Client) getResponser(seq uint32) *Responser {
 	return c.responsers[seq]
 }
 
+func (c *Client) removeResponser(seq uint32) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.responsers, seq)
+}
+
+// newInbound registers a request received of seq, nil if seq is still used by
+// another request.
+func (c *Client) newInbound(seq uint32) *inbound {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.requests[seq]; ok {
+		return nil
+	}
+	in := newInbound(c, seq)
+	c.requests[seq] = in
+	return in
+}
+
+func (c *Client) getInbound(seq uint32) *inbound {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.requests[seq]
+}
+
+func (c *Client) removeInbound(seq uint32) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.requests, seq)
+}
+
 // readPump pumps messages from the websocket connection to the hub.
 //
 // The application runs readPump in a per-connection goroutine. The application
@@ -161,10 +441,10 @@ func (c *Client) readPump() {
 		Hub.unregister(c)
 	}()
 
-	// Problem: websocket: close 1009 (message too big)
-	// Resolution: The application is calling SetReadLimit. Increase the limit or remove the call.
+	// Peers split packets larger than the limit exchanged when login, so a
+	// larger message closes the connection with 1009 (message too big).
 	// refer: https://github.com/gorilla/websocket/issues/283
-	// c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadLimit(int64(maxMessageSize))
 
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
@@ -195,64 +475,161 @@ func (c *Client) writePump() {
 		c.conn.Close()
 		Hub.unregister(c)
 	}()
+	batchSize := 0
+	if c.hasCap(packet.CapBatch) {
+		batchSize = c.messageLimit()
+		if batchSize > maxBatchSize {
+			batchSize = maxBatchSize
+		}
+	}
+	// messages encoded but not written in the previous message, e.g.: the
+	// rest of fragments
+	var pending [][]byte
 	for {
-		select {
-		case message, ok := <-c.sendCh:
-			atom.Log.Debugf("write a message")
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if len(pending) == 0 {
+			var f *frame
+			ok := true
+			select {
+			case f, ok = <-c.sendCh:
+			case <-c.sched.ready:
+				if f = c.sched.pop(); f == nil {
+					continue
+				}
+			case <-ticker.C:
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					atom.Log.Warnf("%v|write ping message error: %v", c.ID, err)
+					return
+				}
+				continue
+			}
 			if !ok {
 				// The hub closed the channel.
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				atom.Log.Warnf("%v|the hub closed the channel", c.ID)
 				return
 			}
-
-			w, err := c.conn.NextWriter(websocket.BinaryMessage)
+			bufs, err := c.encode(f)
 			if err != nil {
-				atom.Log.Warnf("%v|conn's next writer error: %v", c.ID, err)
+				atom.Log.Errorf("%v|%d|encode packet failed: %v", c.ID, f.pkt.Header.Seq, err)
 				return
 			}
-			w.Write(message)
-
-			// Add queued messages to the current websocket message.
-			// TODO(wenchyzhu): client see a frame as a packet, later need to be optimized.
-			// n := len(c.sendCh)
-			// for i := 0; i < n; i++ {
-			// 	w.Write(<-c.sendCh)
-			// }
-
-			if err := w.Close(); err != nil {
-				atom.Log.Warnf("%d|close writer error: %v", c.ID, err)
-				return
+			pending = bufs
+		}
+		atom.Log.Debugf("write a message")
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		w, err := c.conn.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			atom.Log.Warnf("%v|conn's next writer error: %v", c.ID, err)
+			return
+		}
+		w.Write(pending[0])
+		size := len(pending[0])
+		pending = pending[1:]
+
+		// Add queued packets to the current websocket message, as the peer
+		// decodes packets in a message one by one. Packets of sendCh go
+		// first, then frames of streams in turn.
+	batch:
+		for size < batchSize {
+			if len(pending) == 0 {
+				var f *frame
+				select {
+				case next, ok := <-c.sendCh:
+					if !ok {
+						break batch
+					}
+					f = next
+				default:
+					if f = c.sched.pop(); f == nil {
+						break batch
+					}
+				}
+				if pending, err = c.encode(f); err != nil {
+					atom.Log.Errorf("%v|%d|encode packet failed: %v", c.ID, f.pkt.Header.Seq, err)
+					return
+				}
 			}
-		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				atom.Log.Warnf("%v|write ping message error: %v", c.ID, err)
-				return
+			if size+len(pending[0]) > batchSize {
+				break batch
 			}
+			w.Write(pending[0])
+			size += len(pending[0])
+			pending = pending[1:]
+		}
+
+		if err := w.Close(); err != nil {
+			atom.Log.Warnf("%d|close writer error: %v", c.ID, err)
+			return
 		}
 	}
 }
 
-func (c *Client) send(msg []byte) {
-	c.Lock()
-	defer c.Unlock()
+// send queues f to be written, and waits if the queue is full until the
+// connection is closed.
+func (c *Client) send(f *frame) error {
+	c.sendMu.RLock()
+	defer c.sendMu.RUnlock()
 
-	if c.sendChClosed {
-		atom.Log.Warnf("%v|sendCh channel already closed: %v", c.ID)
-		return
+	if atomic.LoadInt32(&c.closed) == 1 {
+		atom.Log.Warnf("%v|sendCh channel already closed", c.ID)
+		return errConnClosed
+	}
+	select {
+	case c.sendCh <- f:
+		return nil
+	case <-c.done:
+		return errConnClosed
+	}
+}
+
+// trySend queues f like send without waiting, for the dispatching goroutine
+// which must not block. errSendQueueFull is returned if the queue is full.
+func (c *Client) trySend(f *frame) error {
+	c.sendMu.RLock()
+	defer c.sendMu.RUnlock()
+
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return errConnClosed
+	}
+	select {
+	case c.sendCh <- f:
+		return nil
+	default:
+		return errSendQueueFull
 	}
-	c.sendCh <- msg
 }
 
+// close closes the send channel, and fails all requests in flight on the
+// connection.
 func (c *Client) close() {
-	c.Lock()
-	defer c.Unlock()
-	if c.sendChClosed {
-		atom.Log.Warnf("%v|sendCh channel already closed: %v", c.ID)
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atom.Log.Warnf("%v|sendCh channel already closed", c.ID)
 		return
 	}
-	c.sendChClosed = true
+	// wake up senders blocked, then close sendCh once they are gone
+	close(c.done)
+	c.sendMu.Lock()
 	close(c.sendCh)
+	c.sendMu.Unlock()
+
+	c.Lock()
+	defer c.Unlock()
+	c.connCredit.close()
+	for _, cr := range c.credits {
+		cr.close()
+	}
+
+	for seq, rsper := range c.responsers {
+		atom.Log.Warnf("%v|%d|connection closed with request in flight", c.ID, seq)
+		rsper.pipe.abort(errConnClosed)
+	}
+	for _, in := range c.requests {
+		in.cancel()
+		in.body.pipe.abort(errConnClosed)
+	}
+	for _, s := range c.streams {
+		s.fail(errConnClosed)
+	}
 }
@@ -0,0 +1,133 @@
+package ws
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Wenchy/bifrost/internal/packet"
+	"github.com/gorilla/websocket"
+)
+
+func TestNextSeq(t *testing.T) {
+	c := newLoopClient(1, "dc-east")
+	c.seq = ^uint32(0) - 1
+	for _, want := range []uint32{^uint32(0), 1, 2} {
+		if got := c.nextSeq(); got != want {
+			t.Errorf("nextSeq() = %d, want %d", got, want)
+		}
+	}
+
+	// concurrent allocation never hands out duplicates
+	const n = 1000
+	var mu sync.Mutex
+	seen := map[uint32]bool{}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			seq := c.nextSeq()
+			mu.Lock()
+			defer mu.Unlock()
+			if seen[seq] {
+				t.Errorf("duplicate seq: %d", seq)
+			}
+			seen[seq] = true
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSendPacketSeqCollision(t *testing.T) {
+	c := newLoopClient(1, "dc-east")
+	c.sendCh = make(chan *frame, 2)
+	rsper := newResponser(c, nil, nil)
+	if err := c.SendPacket(packet.NewSeqPacket(packet.PacketTypeRequest, 7, nil), rsper); err != nil {
+		t.Fatalf("SendPacket() error = %v", err)
+	}
+	err := c.SendPacket(packet.NewSeqPacket(packet.PacketTypeRequest, 7, nil), newResponser(c, nil, nil))
+	if err != errSeqInUse {
+		t.Errorf("SendPacket() error = %v, want %v", err, errSeqInUse)
+	}
+	if c.getResponser(7) != rsper {
+		t.Errorf("responser of seq 7 replaced")
+	}
+}
+
+func TestWritePumpBatching(t *testing.T) {
+	accepted := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade() error = %v", err)
+			return
+		}
+		accepted <- conn
+	}))
+	defer srv.Close()
+	peer, _, err := websocket.DefaultDialer.Dial("ws://"+strings.TrimPrefix(srv.URL, "http://"), nil)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	defer peer.Close()
+
+	c := newLoopClient(1, "dc-east")
+	c.conn = <-accepted
+	c.peerMaxMessageSize = 16 * 1024
+	limit := c.messageLimit()
+	if limit > maxBatchSize {
+		limit = maxBatchSize
+	}
+	// small frames, a frame split into fragments which spill into the next
+	// messages, and small frames again, all queued before written
+	sizes := []int{1024, 1024, 1024, 1024, 1024, 40 * 1024, 1024, 1024}
+	for i, size := range sizes {
+		pkt := packet.NewSeqPacket(packet.PacketTypeStreamData, uint32(i+1), nil)
+		f, err := c.session.frame(pkt, bytes.Repeat([]byte{byte(i)}, size), false)
+		if err != nil {
+			t.Fatalf("frame() error = %v", err)
+		}
+		c.sendCh <- f
+	}
+	go c.writePump()
+	defer c.close()
+
+	var msgs [][]*packet.Packet
+	var seqs []uint32
+	for seq := uint32(0); seq < uint32(len(sizes)); {
+		_, msg, err := peer.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage() error = %v", err)
+		}
+		if len(msg) > limit {
+			t.Errorf("message of %d bytes exceeds %d", len(msg), limit)
+		}
+		pkts, err := packet.ParseAll(msg)
+		if err != nil {
+			t.Fatalf("ParseAll() error = %v", err)
+		}
+		msgs = append(msgs, pkts)
+		for _, pkt := range pkts {
+			seqs = append(seqs, pkt.Header.Seq)
+			if pkt.Header.Flags&packet.FlagMoreFragments == 0 {
+				seq = pkt.Header.Seq
+			}
+		}
+	}
+	if len(msgs[0]) != 5 {
+		t.Errorf("first message holds %d packets, want the 5 small ones", len(msgs[0]))
+	}
+	for i := 1; i < len(seqs); i++ {
+		if seqs[i] < seqs[i-1] {
+			t.Errorf("packets written in order %v, want ascending seqs", seqs)
+			break
+		}
+	}
+	if seqs[len(seqs)-1] != uint32(len(sizes)) {
+		t.Errorf("last packet seq = %d, want %d", seqs[len(seqs)-1], len(sizes))
+	}
+}
@@ -2,11 +2,223 @@ package ws
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
 
 	"github.com/Wenchy/bifrost/internal/atom"
 )
 
+// Names of supported codecs, see SetCodecs.
+const (
+	CodecNone    = "none"
+	CodecGzip    = "gzip"
+	CodecDeflate = "deflate"
+	CodecZlib    = "zlib"
+)
+
+// IDs of supported codecs, which is carried in the packet header to tell the
+// codec of payload.
+const (
+	codecIDNone    uint8 = 0
+	codecIDGzip    uint8 = 1
+	codecIDDeflate uint8 = 2
+	codecIDZlib    uint8 = 3
+)
+
+// Codec compresses payloads sent through the tunnel.
+type Codec interface {
+	ID() uint8
+	Name() string
+	Compress(in []byte) ([]byte, error)
+	Decompress(in []byte) ([]byte, error)
+}
+
+var codecs = map[uint8]Codec{
+	codecIDNone:    noneCodec{},
+	codecIDGzip:    gzipCodec{},
+	codecIDDeflate: deflateCodec{},
+	codecIDZlib:    zlibCodec{},
+}
+
+// defaultCodec is supported by all peers, and used by login packets before a
+// codec is negotiated.
+var defaultCodec Codec = gzipCodec{}
+
+// codecs offered when login in order of preference, see SetCodecs.
+var codecPrefs = []string{CodecGzip, CodecZlib, CodecDeflate, CodecNone}
+
+// SetCodecs sets the codecs supported in order of preference, empty means
+// gzip, zlib, deflate and none. The connection uses the most preferred one of
+// the accepting side which is also supported by the dialing side.
+func SetCodecs(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	for _, name := range names {
+		if codecByName(name) == nil {
+			return fmt.Errorf("unknown codec: %s", name)
+		}
+	}
+	codecPrefs = names
+	return nil
+}
+
+func codecByName(name string) Codec {
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec
+		}
+	}
+	return nil
+}
+
+// negotiateCodec returns the first codec of prefs which is also offered.
+func negotiateCodec(prefs, offered []string) Codec {
+	for _, name := range prefs {
+		for _, o := range offered {
+			if o == name {
+				return codecByName(name)
+			}
+		}
+	}
+	return nil
+}
+
+// Maximum size of a payload decompressed, so that a small payload can not blow
+// up the memory. No payload sent is larger than the reassembly limit.
+const maxDecompressSize = maxReassemblySize
+
+// errDecompressLimit is returned when a payload decompressed exceeds
+// maxDecompressSize.
+var errDecompressLimit = errors.New("decompressed payload too large")
+
+// Payloads smaller than compressMinSize are not compressed, as the codec
+// overhead outweighs the saving.
+const compressMinSize = 256
+
+// Media types of bodies which are already compressed, and matched by prefix.
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/zstd",
+	"application/pdf",
+}
+
+// compressible reports whether the body with header h may benefit from
+// compression, which is false if it is content-encoded or of an already
+// compressed media type.
+func compressible(h http.Header) bool {
+	if enc := h.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return true
+	}
+	if mediaType == "image/svg+xml" {
+		return true
+	}
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(mediaType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+type noneCodec struct{}
+
+func (noneCodec) ID() uint8                            { return codecIDNone }
+func (noneCodec) Name() string                         { return CodecNone }
+func (noneCodec) Compress(in []byte) ([]byte, error)   { return in, nil }
+func (noneCodec) Decompress(in []byte) ([]byte, error) { return in, nil }
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() uint8                            { return codecIDGzip }
+func (gzipCodec) Name() string                         { return CodecGzip }
+func (gzipCodec) Compress(in []byte) ([]byte, error)   { return CompressByGzip(in) }
+func (gzipCodec) Decompress(in []byte) ([]byte, error) { return DecompressByGzip(in) }
+
+type deflateCodec struct{}
+
+func (deflateCodec) ID() uint8    { return codecIDDeflate }
+func (deflateCodec) Name() string { return CodecDeflate }
+
+func (deflateCodec) Compress(in []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	return compress(&buf, zw, in)
+}
+
+func (deflateCodec) Decompress(in []byte) ([]byte, error) {
+	return decompress(flate.NewReader(bytes.NewReader(in)))
+}
+
+type zlibCodec struct{}
+
+func (zlibCodec) ID() uint8    { return codecIDZlib }
+func (zlibCodec) Name() string { return CodecZlib }
+
+func (zlibCodec) Compress(in []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	return compress(&buf, zlib.NewWriter(&buf), in)
+}
+
+func (zlibCodec) Decompress(in []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+	return decompress(zr)
+}
+
+// compress writes in to zw, and returns the compressed bytes in buf.
+func compress(buf *bytes.Buffer, zw io.WriteCloser, in []byte) ([]byte, error) {
+	if _, err := zw.Write(in); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress reads all from zr and closes it, no more than maxDecompressSize.
+func decompress(zr io.ReadCloser) ([]byte, error) {
+	var outbuf bytes.Buffer
+	n, err := outbuf.ReadFrom(io.LimitReader(zr, maxDecompressSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > maxDecompressSize {
+		return nil, errDecompressLimit
+	}
+	if err := zr.Close(); err != nil {
+		return nil, err
+	}
+	return outbuf.Bytes(), nil
+}
+
 func CompressByGzip(in []byte) ([]byte, error) {
 	var buf bytes.Buffer
 	zw := gzip.NewWriter(&buf)
@@ -38,16 +250,10 @@ func DecompressByGzip(in []byte) ([]byte, error) {
 	}
 
 	// fmt.Printf("Name: %s\nComment: %s\nModTime: %s\n\n", zr.Name, zr.Comment, zr.ModTime.UTC())
-	var outbuf bytes.Buffer
-	if _, err := outbuf.ReadFrom(zr); err != nil {
-		atom.Log.Errorf("ReadFrom failed: %s", err)
-		return nil, err
-	}
-
-	if err := zr.Close(); err != nil {
-		atom.Log.Errorf("Close failed: %s", err)
+	out, err := decompress(zr)
+	if err != nil {
+		atom.Log.Errorf("decompress failed: %s", err)
 		return nil, err
 	}
-
-	return outbuf.Bytes(), nil
+	return out, nil
 }
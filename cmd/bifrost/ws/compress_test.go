@@ -0,0 +1,88 @@
+package ws
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	input := bytes.Repeat([]byte("To be compressed content."), 100)
+	for _, codec := range codecs {
+		t.Run(codec.Name(), func(t *testing.T) {
+			compressed, err := codec.Compress(input)
+			if err != nil {
+				t.Fatalf("Compress() error = %v", err)
+			}
+			output, err := codec.Decompress(compressed)
+			if err != nil {
+				t.Fatalf("Decompress() error = %v", err)
+			}
+			if !bytes.Equal(output, input) {
+				t.Errorf("Decompress() = %q, want %q", output, input)
+			}
+		})
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	// compressed to a few KB, but larger than the limit once decompressed
+	input := make([]byte, maxDecompressSize+1)
+	for _, codec := range []Codec{gzipCodec{}, deflateCodec{}, zlibCodec{}} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			compressed, err := codec.Compress(input)
+			if err != nil {
+				t.Fatalf("Compress() error = %v", err)
+			}
+			if _, err := codec.Decompress(compressed); err != errDecompressLimit {
+				t.Errorf("Decompress() error = %v, want %v", err, errDecompressLimit)
+			}
+		})
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		prefs   []string
+		offered []string
+		want    string
+	}{
+		{name: "most preferred", prefs: []string{CodecZlib, CodecGzip}, offered: []string{CodecGzip, CodecZlib}, want: CodecZlib},
+		{name: "common one", prefs: []string{CodecDeflate, CodecGzip}, offered: []string{CodecNone, CodecGzip}, want: CodecGzip},
+		{name: "nothing common", prefs: []string{CodecDeflate}, offered: []string{CodecGzip}, want: ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if codec := negotiateCodec(tt.prefs, tt.offered); codec != nil {
+				got = codec.Name()
+			}
+			if got != tt.want {
+				t.Errorf("negotiateCodec() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{name: "no content type", header: http.Header{}, want: true},
+		{name: "html", header: http.Header{"Content-Type": {"text/html; charset=utf-8"}}, want: true},
+		{name: "jpeg", header: http.Header{"Content-Type": {"image/jpeg"}}, want: false},
+		{name: "svg", header: http.Header{"Content-Type": {"image/svg+xml"}}, want: true},
+		{name: "video", header: http.Header{"Content-Type": {"video/mp4"}}, want: false},
+		{name: "zip", header: http.Header{"Content-Type": {"application/zip"}}, want: false},
+		{name: "gzipped", header: http.Header{"Content-Type": {"text/css"}, "Content-Encoding": {"gzip"}}, want: false},
+		{name: "identity", header: http.Header{"Content-Encoding": {"identity"}}, want: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compressible(tt.header); got != tt.want {
+				t.Errorf("compressible() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/Wenchy/bifrost/internal/atom"
+)
+
+// Connect serves req of method CONNECT like an HTTP proxy: a TCP stream is
+// opened to the target("host:port") through the peer of name, any peer if
+// empty, then the hijacked connection is piped with it once "200 Connection
+// established" is responded. Tunnel errors before that are responded as
+// those of Forward. The client must present a verified certificate allowed
+// like peers, or "403 Forbidden" is responded.
+func Connect(peer string, rw http.ResponseWriter, req *http.Request) {
+	if err := verifyProxyClient(req); err != nil {
+		atom.Log.Warnf("connect from %s rejected: %v", req.RemoteAddr, err)
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	}
+	target := req.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		writeError(rw, errCodeRouteDenied, "invalid target: "+target)
+		return
+	}
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		writeError(rw, errCodeInternal, "hijacking not supported")
+		return
+	}
+	c, err := Hub.pick(peer, target)
+	if err != nil {
+		atom.Log.Warnf("pick client failed: %v", err)
+		te := err.(*tunnelError)
+		writeError(rw, te.code, te.msg)
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), requestTimeout)
+	s, err := c.OpenStream(ctx, StreamTCP, target)
+	cancel()
+	if err != nil {
+		atom.Log.Errorf("%v|connect %s failed: %v", c.ID, target, err)
+		var te *tunnelError
+		switch {
+		case errors.As(err, &te):
+			writeError(rw, te.code, te.msg)
+		case err == context.DeadlineExceeded:
+			writeError(rw, errCodeTimeout, "connect timeout")
+		case err == errConnClosed:
+			writeError(rw, errCodeConnClosed, err.Error())
+		case req.Context().Err() != nil:
+			// client gone
+		default:
+			writeError(rw, errCodeInternal, err.Error())
+		}
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		atom.Log.Errorf("%v|%d|hijack failed: %v", c.ID, s.id, err)
+		s.Close()
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		conn.Close()
+		s.Close()
+		return
+	}
+	// bytes sent by the client before the response, e.g.: TLS client hello
+	if n := brw.Reader.Buffered(); n > 0 {
+		buf, _ := brw.Reader.Peek(n)
+		if _, err := s.Write(buf); err != nil {
+			conn.Close()
+			s.Close()
+			return
+		}
+	}
+	atom.Log.Debugf("%v|%d|connect %s to %s", c.ID, s.id, conn.RemoteAddr(), target)
+	pipe(conn, s)
+}
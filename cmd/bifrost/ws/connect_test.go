@@ -0,0 +1,106 @@
+package ws
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestConnect(t *testing.T) {
+	dialPair(t)
+	target := echoServer(t)
+	SetTCPTargets(map[string][]string{"*": {target, "127.0.0.1:1"}})
+	defer SetTCPTargets(nil)
+	// hijacked connections are not waited for by the server, so wait for
+	// Connect to return, which is after the tunnel is piped
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	certFile, keyFile := genSelfSignedCert(t, t.TempDir())
+	serverTLSConf, err := NewServerTLSConfig(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatalf("NewServerTLSConfig failed: %v", err)
+	}
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+		Connect("", rw, req)
+	}))
+	proxy.TLS = serverTLSConf
+	proxy.StartTLS()
+	defer proxy.Close()
+	clientTLSConf, err := NewDialTLSConfig(certFile, keyFile, certFile, "")
+	if err != nil {
+		t.Fatalf("NewDialTLSConfig failed: %v", err)
+	}
+
+	connectWith := func(conf *tls.Config, addr string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := tls.Dial("tcp", proxy.Listener.Addr().String(), conf)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+		br := bufio.NewReader(conn)
+		rsp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("ReadResponse() error = %v", err)
+		}
+		return conn, br, rsp
+	}
+	connect := func(addr string) (net.Conn, *bufio.Reader, *http.Response) {
+		return connectWith(clientTLSConf, addr)
+	}
+
+	conn, br, rsp := connect(target)
+	defer conn.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want %d", rsp.StatusCode, http.StatusOK)
+	}
+	fmt.Fprint(conn, "ping\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Errorf("ReadString() = %q, %v, want ping", line, err)
+	}
+
+	for _, tt := range []struct {
+		addr string
+		want errCode
+	}{
+		{addr: "127.0.0.1:1", want: errCodeUnreachable},
+		{addr: "127.0.0.1", want: errCodeRouteDenied},
+		{addr: "127.0.0.1:2", want: errCodeRouteDenied},
+	} {
+		conn, _, rsp := connect(tt.addr)
+		conn.Close()
+		if got := rsp.Header.Get(errorHeader); got != tt.want.String() || rsp.StatusCode != tt.want.status() {
+			t.Errorf("CONNECT %s = %d %s, want %d %s", tt.addr, rsp.StatusCode, got, tt.want.status(), tt.want)
+		}
+	}
+
+	// clients without a verified certificate allowed like peers are rejected
+	noCertConf, err := NewDialTLSConfig("", "", certFile, "")
+	if err != nil {
+		t.Fatalf("NewDialTLSConfig failed: %v", err)
+	}
+	RequirePeerCert([]string{"dc-east"})
+	defer func() {
+		peerCertRequired = false
+		allowedPeers = nil
+	}()
+	for _, tt := range []struct {
+		name string
+		conf *tls.Config
+	}{
+		{name: "no client cert", conf: noCertConf},
+		{name: "peer not allowed", conf: clientTLSConf},
+	} {
+		conn, _, rsp := connectWith(tt.conf, target)
+		conn.Close()
+		if rsp.StatusCode != http.StatusForbidden {
+			t.Errorf("CONNECT with %s status = %d, want %d", tt.name, rsp.StatusCode, http.StatusForbidden)
+		}
+	}
+}
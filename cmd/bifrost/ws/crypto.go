@@ -4,50 +4,140 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Names of supported ciphers, see SetCipher.
+const (
+	CipherAES256GCM        = "aes-256-gcm"
+	CipherChaCha20Poly1305 = "chacha20-poly1305"
+)
+
+// Version of ciphertext format, which is the first byte of ciphertext. Peers
+// with a different version can not decrypt each other's ciphertext.
+//
+// version 1: version(1) | cipher ID(1) | nonce | sealed input and tag
+// version 2: version(1) | cipher ID(1) | key ID(1) | nonce | sealed input and tag
+const cipherVersion byte = 2
+
+// Size of the ciphertext prefix before nonce, which is authenticated as
+// additional data.
+const cipherPrefixSize = 3
+
+// Sizes of nonce and tag of all supported ciphers, so that the size of
+// ciphertext is known before encrypted.
+const (
+	nonceSize = 12
+	tagSize   = 16
+
+	// bytes added to input by Encrypt
+	cipherOverhead = cipherPrefixSize + nonceSize + tagSize
 )
 
-var cipherKey []byte
+// IDs of supported ciphers, which is the second byte of ciphertext.
+const (
+	cipherIDAES256GCM        byte = 1
+	cipherIDChaCha20Poly1305 byte = 2
+)
+
+var cipherIDs = map[string]byte{
+	CipherAES256GCM:        cipherIDAES256GCM,
+	CipherChaCha20Poly1305: cipherIDChaCha20Poly1305,
+}
+
+// ErrCipherVersion is returned when decrypting a ciphertext of an unsupported
+// version, which is probably sent by an incompatible peer.
+var ErrCipherVersion = errors.New("unsupported ciphertext version")
 
-func init() {
-	hexKey := "904F4BD34C303D2A2F5C609D3DEF710FEEBDE497DF4840380927D744D343D4CD" 
-	cipherKey, _ = hex.DecodeString(hexKey)
-	// fmt.Printf("cipher key: %v\n", cipherKey)
+// ID of the cipher used by Encrypt, see SetCipher. It is accessed atomically,
+// as connections may be encrypting meanwhile.
+var cipherID = uint32(cipherIDAES256GCM)
+
+// SetCipher sets the cipher used to encrypt, empty means CipherAES256GCM.
+// Ciphertext of any supported cipher can be decrypted.
+func SetCipher(name string) error {
+	if name == "" {
+		name = CipherAES256GCM
+	}
+	id, ok := cipherIDs[name]
+	if !ok {
+		return fmt.Errorf("unknown cipher: %s", name)
+	}
+	atomic.StoreUint32(&cipherID, uint32(id))
+	return nil
 }
 
-// refer: https://golang.org/pkg/crypto/cipher/#example_NewCFBDecrypter
-func Encrypt(key, input []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+func newAEAD(id byte, key []byte) (cipher.AEAD, error) {
+	switch id {
+	case cipherIDAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case cipherIDChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("unknown cipher ID: %d", id)
+	}
+}
+
+// Encrypt encrypts and authenticates input by AEAD with the active key of kr.
+// The ciphertext is laid out as: version(1) | cipher ID(1) | key ID(1) |
+// nonce | sealed input and tag, and the prefix before nonce is authenticated
+// as additional data.
+func Encrypt(kr *Keyring, input []byte) ([]byte, error) {
+	keyID, key, err := kr.activeKey()
 	if err != nil {
 		return nil, err
 	}
-
-	ciphertext := make([]byte, aes.BlockSize+len(input))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	id := byte(atomic.LoadUint32(&cipherID))
+	aead, err := newAEAD(id, key)
+	if err != nil {
 		return nil, err
 	}
-	cfb := cipher.NewCFBEncrypter(block, iv)
-	cfb.XORKeyStream(ciphertext[aes.BlockSize:], input)
-	return ciphertext, nil
+	prefixSize := cipherPrefixSize + aead.NonceSize()
+	ciphertext := make([]byte, prefixSize, prefixSize+len(input)+aead.Overhead())
+	ciphertext[0] = cipherVersion
+	ciphertext[1] = id
+	ciphertext[2] = keyID
+	nonce := ciphertext[cipherPrefixSize:prefixSize]
+	// The nonce needs to be unique, a random one is fine for a 96-bit nonce.
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(ciphertext, nonce, input, ciphertext[:cipherPrefixSize]), nil
 }
 
-func Decrypt(key, input []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+// Decrypt verifies and decrypts the ciphertext produced by Encrypt, with the
+// key of kr which the ciphertext is encrypted by. Tampered input is rejected.
+func Decrypt(kr *Keyring, input []byte) ([]byte, error) {
+	if len(input) < 1 {
+		return nil, errors.New("ciphertext too short")
+	}
+	if input[0] != cipherVersion {
+		return nil, fmt.Errorf("%w: %d, want %d", ErrCipherVersion, input[0], cipherVersion)
+	}
+	if len(input) < cipherPrefixSize {
+		return nil, errors.New("ciphertext too short")
+	}
+	key, err := kr.key(input[2])
 	if err != nil {
 		return nil, err
 	}
-	// The IV needs to be unique, but not secure. Therefore it's common to
-	// include it at the beginning of the ciphertext.
-	if len(input) < aes.BlockSize {
+	aead, err := newAEAD(input[1], key)
+	if err != nil {
+		return nil, err
+	}
+	prefixSize := cipherPrefixSize + aead.NonceSize()
+	if len(input) < prefixSize+aead.Overhead() {
 		return nil, errors.New("ciphertext too short")
 	}
-	iv := input[:aes.BlockSize]
-	input = input[aes.BlockSize:]
-	// XORKeyStream can work input-place if the two arguments are the same.
-	cfb := cipher.NewCFBDecrypter(block, iv)
-	cfb.XORKeyStream(input, input)
-	return input, nil
-}
\ No newline at end of file
+	nonce := input[cipherPrefixSize:prefixSize]
+	return aead.Open(nil, nonce, input[prefixSize:], input[:cipherPrefixSize])
+}
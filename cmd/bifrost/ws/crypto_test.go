@@ -1,6 +1,7 @@
 package ws
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 )
@@ -8,8 +9,9 @@ import (
 func TestEncryptDecrypt(t *testing.T) {
 	input := []byte("To be encrypted content.")
 	type args struct {
-		key   []byte
-		input []byte
+		cipher string
+		kr     *Keyring
+		input  []byte
 	}
 	tests := []struct {
 		name    string
@@ -17,31 +19,137 @@ func TestEncryptDecrypt(t *testing.T) {
 		want    []byte
 		wantErr bool
 	}{
-		// TODO: Add test cases.
 		{
 			name: "Test case 1",
 			args: args{
-				key:   cipherKey,
-				input: input,
+				cipher: CipherAES256GCM,
+				kr:     testKeyring,
+				input:  input,
 			},
-			want:    []byte(""),
+			want:    input,
+			wantErr: false,
+		},
+		{
+			name: "ChaCha20-Poly1305",
+			args: args{
+				cipher: CipherChaCha20Poly1305,
+				kr:     testKeyring,
+				input:  input,
+			},
+			want:    input,
+			wantErr: false,
+		},
+		{
+			name: "empty input",
+			args: args{
+				cipher: CipherAES256GCM,
+				kr:     testKeyring,
+				input:  []byte{},
+			},
+			want:    []byte{},
 			wantErr: false,
 		},
 	}
+	defer SetCipher("")
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := Encrypt(tt.args.key, tt.args.input)
+			if err := SetCipher(tt.args.cipher); err != nil {
+				t.Fatalf("SetCipher() error = %v", err)
+			}
+			got, err := Encrypt(tt.args.kr, tt.args.input)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Encrypt() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			output, err := Decrypt(tt.args.key, got)
+			if len(got) != len(tt.args.input)+cipherOverhead {
+				t.Errorf("Encrypt() size = %d, want %d", len(got), len(tt.args.input)+cipherOverhead)
+			}
+			output, err := Decrypt(tt.args.kr, got)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("Encrypt() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("Decrypt() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !reflect.DeepEqual(input, output) {
-				t.Errorf("Encrypt() = %v, want %v", got, tt.want)
+			if len(output) != len(tt.want) || (len(output) != 0 && !reflect.DeepEqual(output, tt.want)) {
+				t.Errorf("Decrypt() = %v, want %v", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	ciphertext, err := Encrypt(testKeyring, []byte("To be encrypted content."))
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		tamper  func(b []byte)
+		wantErr error
+	}{
+		{name: "payload", tamper: func(b []byte) { b[len(b)-1] ^= 0xff }},
+		{name: "cipher ID", tamper: func(b []byte) { b[1] = cipherIDChaCha20Poly1305 }},
+		{name: "key ID", tamper: func(b []byte) { b[2] = 2 }},
+		{name: "version", tamper: func(b []byte) { b[0] = cipherVersion + 1 }, wantErr: ErrCipherVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := append([]byte(nil), ciphertext...)
+			tt.tamper(b)
+			_, err := Decrypt(testKeyring, b)
+			if err == nil {
+				t.Fatalf("Decrypt() of tampered %s succeeded", tt.name)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Decrypt() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey, _ := GenKey()
+	newKey, _ := GenKey()
+	newKeyring := func(active uint8, keys map[uint8]string) *Keyring {
+		kr := NewKeyring(active)
+		for id, hexKey := range keys {
+			key, err := LoadKey(hexKey, "", "")
+			if err != nil {
+				t.Fatalf("LoadKey() error = %v", err)
+			}
+			if err := kr.Add(id, key); err != nil {
+				t.Fatalf("Add() error = %v", err)
+			}
+		}
+		return kr
+	}
+	// a peer has switched to the new key, while the other still encrypts by
+	// the old key during rotation
+	rotated := newKeyring(2, map[uint8]string{1: oldKey, 2: newKey})
+	rotating := newKeyring(1, map[uint8]string{1: oldKey, 2: newKey})
+	stale := newKeyring(1, map[uint8]string{1: oldKey})
+
+	input := []byte("To be encrypted content.")
+	for _, tt := range []struct {
+		name    string
+		from    *Keyring
+		to      *Keyring
+		wantErr bool
+	}{
+		{name: "old key to rotated", from: rotating, to: rotated},
+		{name: "new key to rotating", from: rotated, to: rotating},
+		{name: "new key to stale", from: rotated, to: stale, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ciphertext, err := Encrypt(tt.from, input)
+			if err != nil {
+				t.Fatalf("Encrypt() error = %v", err)
+			}
+			output, err := Decrypt(tt.to, ciphertext)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decrypt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(output, input) {
+				t.Errorf("Decrypt() = %v, want %v", output, input)
 			}
 		})
 	}
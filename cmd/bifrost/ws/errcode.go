@@ -0,0 +1,101 @@
+package ws
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// errCode is a structured tunnel error, which is carried in the header code
+// of a response packet instead of the response of target. It is mapped to the
+// status and the "X-Bifrost-Error" header of the response to the requesting
+// client, so that tunnel failures are told from responses of target.
+type errCode int32
+
+const (
+	errCodeNone        errCode = iota
+	errCodeUnreachable         // target refused or unreachable
+	errCodeDNS                 // target host not resolved
+	errCodeTimeout             // requesting target timed out
+	errCodeTLS                 // TLS handshake with target failed
+	errCodeDecode              // packet from the tunnel can not be decoded
+	errCodeRouteDenied         // target is invalid or not allowed
+	errCodeNoPeer              // no peer connected to go through
+	errCodeConnClosed          // connection closed before responded
+	errCodeInternal            // other tunnel failures
+	errCodeOverloaded          // request shed as the tunnel is saturated
+	errCodePeerOffline         // the named peer is not connected
+)
+
+// HTTP header of responses to tell the tunnel error.
+const errorHeader = "X-Bifrost-Error"
+
+var errCodes = map[errCode]struct {
+	name   string
+	status int
+}{
+	errCodeUnreachable: {"target_unreachable", http.StatusBadGateway},
+	errCodeDNS:         {"dns_failure", http.StatusBadGateway},
+	errCodeTimeout:     {"timeout", http.StatusGatewayTimeout},
+	errCodeTLS:         {"tls_error", http.StatusBadGateway},
+	errCodeDecode:      {"decode_failure", http.StatusBadGateway},
+	errCodeRouteDenied: {"route_denied", http.StatusBadGateway},
+	errCodeNoPeer:      {"no_peer", http.StatusServiceUnavailable},
+	errCodeConnClosed:  {"connection_closed", http.StatusBadGateway},
+	errCodeInternal:    {"tunnel_error", http.StatusBadGateway},
+	errCodeOverloaded:  {"overloaded", http.StatusServiceUnavailable},
+	errCodePeerOffline: {"peer_offline", http.StatusBadGateway},
+}
+
+func (c errCode) String() string {
+	if e, ok := errCodes[c]; ok {
+		return e.name
+	}
+	return errCodes[errCodeInternal].name
+}
+
+// status returns the HTTP status responded for the error.
+func (c errCode) status() int {
+	if e, ok := errCodes[c]; ok {
+		return e.status
+	}
+	return http.StatusBadGateway
+}
+
+// tunnelError is an error with a code, which is either reported by the peer
+// or occurs locally.
+type tunnelError struct {
+	code errCode
+	msg  string
+}
+
+func (e *tunnelError) Error() string {
+	return e.code.String() + ": " + e.msg
+}
+
+// errorCode classifies err of requesting the target. A tunnel error keeps its
+// code.
+func errorCode(err error) errCode {
+	var te *tunnelError
+	var dnsErr *net.DNSError
+	var hostErr x509.HostnameError
+	var authErr x509.UnknownAuthorityError
+	var certErr x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &te):
+		return te.code
+	case errors.As(err, &dnsErr):
+		return errCodeDNS
+	case errors.As(err, &hostErr), errors.As(err, &authErr), errors.As(err, &certErr), errors.As(err, &recordErr):
+		return errCodeTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return errCodeTimeout
+	default:
+		return errCodeUnreachable
+	}
+}
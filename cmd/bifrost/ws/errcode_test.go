@@ -0,0 +1,81 @@
+package ws
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestErrorCode(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		err        error
+		want       errCode
+		wantStatus int
+	}{
+		{name: "refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, want: errCodeUnreachable, wantStatus: http.StatusBadGateway},
+		{name: "dns", err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "nowhere"}}, want: errCodeDNS, wantStatus: http.StatusBadGateway},
+		{name: "timeout", err: context.DeadlineExceeded, want: errCodeTimeout, wantStatus: http.StatusGatewayTimeout},
+		{name: "tls", err: x509.UnknownAuthorityError{}, want: errCodeTLS, wantStatus: http.StatusBadGateway},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := &url.Error{Op: "Get", URL: "http://target", Err: tt.err}
+			got := errorCode(err)
+			if got != tt.want {
+				t.Errorf("errorCode() = %v, want %v", got, tt.want)
+			}
+			if got.status() != tt.wantStatus {
+				t.Errorf("status() = %v, want %v", got.status(), tt.wantStatus)
+			}
+		})
+	}
+}
+
+// hijackRecorder is a recorder which claims to be a hijacker, as required by
+// Connect.
+type hijackRecorder struct {
+	http.ResponseWriter
+}
+
+func (hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("not hijackable")
+}
+
+func TestNoPeerStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		do   func(rw http.ResponseWriter, req *http.Request)
+		want errCode
+	}{
+		{name: "forward", do: func(rw http.ResponseWriter, req *http.Request) {
+			Forward("http://target", "dc-offline", rw, req)
+		}, want: errCodePeerOffline},
+		{name: "connect", do: func(rw http.ResponseWriter, req *http.Request) {
+			// as if a client certificate is verified
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "dc-east"}}}}}
+			Connect("dc-offline", hijackRecorder{rw}, req)
+		}, want: errCodePeerOffline},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tt.do(rec, httptest.NewRequest(http.MethodConnect, "http://target:443", nil))
+			if got := rec.Header().Get(errorHeader); got != tt.want.String() || rec.Code != http.StatusBadGateway {
+				t.Errorf("status = %d %s, want %d %s", rec.Code, got, http.StatusBadGateway, tt.want)
+			}
+		})
+	}
+	// no peer at all
+	_, err := NewDefaultHub().pick("", "target")
+	var te *tunnelError
+	if !errors.As(err, &te) || te.code != errCodeNoPeer || te.code.status() != http.StatusServiceUnavailable {
+		t.Errorf("pick() error = %v, want %s", err, errCodeNoPeer)
+	}
+}
@@ -0,0 +1,369 @@
+package ws
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Wenchy/bifrost/internal/atom"
+	"github.com/Wenchy/bifrost/internal/packet"
+)
+
+// Body chunks are flow controlled by credits in bytes, which the receiver
+// grants back as chunks are consumed. A chunk is charged by its payload and
+// header size, so that the memory buffered by the receiver is bounded.
+const (
+	// Initial credit of a body stream.
+	streamWindow = 256 * 1024
+	// Initial credit of a connection shared by all its body streams.
+	connWindow = 4 * 1024 * 1024
+	// Credit consumed by the receiver is granted back once it reaches this.
+	windowUpdateThreshold = streamWindow / 4
+)
+
+// Size of window update payload: type of body chunks(1) | credit(4) |
+// scope(1).
+const windowUpdateSize = 6
+
+// Scopes of credit granted by a window update of a body stream. A window
+// update of seq 0 grants the connection credit only.
+const (
+	grantAll    byte = 0 // both the body stream and the connection
+	grantStream byte = 1 // the body stream only, as the connection credit has been granted
+)
+
+// Policies when the tunnel is saturated, see SetFlowControl.
+const (
+	SaturationBlock = "block" // wait until a slot is freed
+	SaturationShed  = "shed"  // respond 503 at once
+	SaturationQueue = "queue" // wait if less than the queue limit are waiting, otherwise respond 503
+)
+
+// errSaturated is returned when a request is shed as the tunnel is saturated.
+var errSaturated = errors.New("tunnel saturated")
+
+// credit is the bytes allowed to send, which is taken by the sender and
+// granted back by the receiver.
+type credit struct {
+	mu     sync.Mutex
+	n      int
+	grant  chan struct{} // closed and renewed when granted, to wake up all takers
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newCredit(n int) *credit {
+	return &credit{n: n, grant: make(chan struct{}), closed: make(chan struct{})}
+}
+
+// take waits until n bytes are available and takes them, or returns early if
+// done is closed or the credit is closed.
+func (cr *credit) take(n int, done <-chan struct{}) error {
+	for {
+		cr.mu.Lock()
+		if cr.n >= n {
+			cr.n -= n
+			cr.mu.Unlock()
+			return nil
+		}
+		grant := cr.grant
+		cr.mu.Unlock()
+		select {
+		case <-grant:
+		case <-cr.closed:
+			return errConnClosed
+		case <-done:
+			return errPipeDone
+		}
+	}
+}
+
+// add grants back n bytes.
+func (cr *credit) add(n int) {
+	cr.mu.Lock()
+	cr.n += n
+	close(cr.grant)
+	cr.grant = make(chan struct{})
+	cr.mu.Unlock()
+}
+
+// close wakes up all takers with errConnClosed.
+func (cr *credit) close() {
+	cr.once.Do(func() { close(cr.closed) })
+}
+
+// max packets buffered by the pipe of a request or stream from a peer without
+// flow control.
+const maxPipePackets = 64
+
+// pipeLimit returns the max packets buffered by the pipe of a request or
+// stream from the peer, 0 if bounded by the credits of flow control.
+func (c *Client) pipeLimit() int {
+	if c.hasCap(packet.CapFlowControl) {
+		return 0
+	}
+	return maxPipePackets
+}
+
+// charge returns the credit charged for a body chunk packet, by the size of
+// payload sealed.
+func charge(pkt *packet.Packet) int {
+	return packet.HeaderSize + int(pkt.Header.Size)
+}
+
+// takeCredit waits for the credit of the body stream and the connection to
+// send f, if the peer supports flow control.
+func (c *Client) takeCredit(f *frame, done <-chan struct{}) error {
+	if !c.hasCap(packet.CapFlowControl) {
+		return nil
+	}
+	n := f.charge()
+	if cr := c.streamCredit(f.pkt.Header.Type, f.pkt.Header.Seq); cr != nil {
+		if err := cr.take(n, done); err != nil {
+			return err
+		}
+	}
+	return c.connCredit.take(n, done)
+}
+
+// openStreamCredit creates the credit to send the body stream of key.
+func (c *Client) openStreamCredit(key streamKey) {
+	c.Lock()
+	defer c.Unlock()
+	c.credits[key] = newCredit(streamWindow)
+}
+
+// closeStreamCredit removes the credit of key, and wakes up its takers.
+func (c *Client) closeStreamCredit(key streamKey) {
+	c.Lock()
+	defer c.Unlock()
+	if cr, ok := c.credits[key]; ok {
+		cr.close()
+		delete(c.credits, key)
+	}
+}
+
+func (c *Client) streamCredit(typ packet.PacketType, seq uint32) *credit {
+	c.RLock()
+	defer c.RUnlock()
+	return c.credits[streamKey{typ: typ, seq: seq}]
+}
+
+// grant grants n bytes of credit back to the peer for the body stream of typ
+// and seq, which also replenishes the connection credit. If seq is 0, only
+// the connection credit is granted.
+func (c *Client) grant(typ packet.PacketType, seq uint32, n int) {
+	c.sendWindow(typ, seq, n, grantAll)
+}
+
+// grantStream grants n bytes of credit back to the peer for the body stream
+// of typ and seq, without the connection credit which has been granted.
+func (c *Client) grantStream(typ packet.PacketType, seq uint32, n int) {
+	c.sendWindow(typ, seq, n, grantStream)
+}
+
+func (c *Client) sendWindow(typ packet.PacketType, seq uint32, n int, scope byte) {
+	if n <= 0 || !c.hasCap(packet.CapFlowControl) {
+		return
+	}
+	raw := make([]byte, windowUpdateSize)
+	raw[0] = byte(typ)
+	binary.BigEndian.PutUint32(raw[1:], uint32(n))
+	raw[5] = scope
+	pkt := packet.NewSeqPacket(packet.PacketTypeWindow, seq, nil)
+	if err := c.sendSealed(pkt, raw, false); err != nil {
+		atom.Log.Debugf("%v|%d|send window update failed: %v", c.ID, seq, err)
+	}
+}
+
+// grantDropped grants back the credit of pkt if it is a body chunk dropped
+// before read, so that the peer is not blocked sending the rest of body, e.g.:
+// the request is responded before its body is read.
+func (c *Client) grantDropped(pkt *packet.Packet) {
+	switch pkt.Header.Type {
+	case packet.PacketTypeRequestBody, packet.PacketTypeResponseBody, packet.PacketTypeStreamData:
+		c.grant(pkt.Header.Type, pkt.Header.Seq, charge(pkt))
+	}
+}
+
+// handleWindow adds the credit granted by the peer.
+func (c *Client) handleWindow(pkt *packet.Packet) {
+	raw, err := c.session.unseal(pkt)
+	if err != nil {
+		atom.Log.Warnf("%v|%d|unseal window update failed: %v", c.ID, pkt.Header.Seq, err)
+		return
+	}
+	if len(raw) != windowUpdateSize {
+		atom.Log.Warnf("%v|%d|invalid window update", c.ID, pkt.Header.Seq)
+		return
+	}
+	n := int(binary.BigEndian.Uint32(raw[1:5]))
+	if pkt.Header.Seq != 0 {
+		if cr := c.streamCredit(packet.PacketType(raw[0]), pkt.Header.Seq); cr != nil {
+			cr.add(n)
+		}
+	}
+	if raw[5] != grantStream {
+		c.connCredit.add(n)
+	}
+}
+
+// limiter bounds the requests handled at the same time, and applies the
+// saturation policy when all slots are taken.
+type limiter struct {
+	slots      chan struct{}
+	policy     string
+	queued     int32
+	queueLimit int32
+
+	mu      sync.Mutex
+	waiters []waiter // callers of start waiting for a slot in order
+}
+
+// waiter is a caller of limiter.start waiting for a slot.
+type waiter struct {
+	done <-chan struct{}
+	fn   func(error)
+}
+
+func newLimiter(size int, policy string, queueLimit int) *limiter {
+	return &limiter{
+		slots:      make(chan struct{}, size),
+		policy:     policy,
+		queueLimit: int32(queueLimit),
+	}
+}
+
+// acquire takes a slot, and returns errSaturated if shed by the policy. It
+// stops waiting if done is closed.
+func (l *limiter) acquire(done <-chan struct{}) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	switch l.policy {
+	case SaturationShed:
+		return errSaturated
+	case SaturationQueue:
+		if atomic.AddInt32(&l.queued, 1) > l.queueLimit {
+			atomic.AddInt32(&l.queued, -1)
+			return errSaturated
+		}
+		defer atomic.AddInt32(&l.queued, -1)
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-done:
+		return errPipeDone
+	}
+}
+
+// start calls fn in a new goroutine once a slot is taken without blocking the
+// caller, so that requests waiting for a slot cost no goroutine. fn must
+// release the slot, and is called with errPipeDone instead if done is closed
+// while waiting. errSaturated is returned at once if shed by the policy, and
+// fn is never called then.
+func (l *limiter) start(done <-chan struct{}, fn func(error)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiters) == 0 {
+		select {
+		case l.slots <- struct{}{}:
+			go fn(nil)
+			return nil
+		default:
+		}
+	}
+	switch l.policy {
+	case SaturationShed:
+		return errSaturated
+	case SaturationQueue:
+		if len(l.waiters) >= int(l.queueLimit) {
+			l.pruneWaiters()
+		}
+		if len(l.waiters) >= int(l.queueLimit) {
+			return errSaturated
+		}
+	}
+	l.waiters = append(l.waiters, waiter{done: done, fn: fn})
+	return nil
+}
+
+// pruneWaiters removes the waiters no longer waiting. l.mu must be held.
+func (l *limiter) pruneWaiters() {
+	waiters := l.waiters[:0]
+	for _, w := range l.waiters {
+		select {
+		case <-w.done:
+			go w.fn(errPipeDone)
+		default:
+			waiters = append(waiters, w)
+		}
+	}
+	for i := len(waiters); i < len(l.waiters); i++ {
+		l.waiters[i] = waiter{}
+	}
+	l.waiters = waiters
+}
+
+// release frees a slot, which is handed over to the first waiter of start
+// still waiting if any.
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.waiters) != 0 {
+		w := l.waiters[0]
+		l.waiters[0] = waiter{}
+		l.waiters = l.waiters[1:]
+		select {
+		case <-w.done:
+			go w.fn(errPipeDone)
+		default:
+			go w.fn(nil)
+			return
+		}
+	}
+	<-l.slots
+}
+
+// limiters of requests from peers handled by workers, and requests sent to
+// peers, see SetFlowControl.
+var (
+	workers  = newLimiter(256, SaturationBlock, 0)
+	outbound = newLimiter(1024, SaturationBlock, 0)
+)
+
+// Default maximum number of requests waiting by SaturationQueue.
+const defaultQueueLimit = 256
+
+// SetFlowControl sets the maximum number of requests from peers handled at
+// the same time, the maximum number of requests sent to peers waiting for
+// response, and the policy when either is reached. Zero means the default,
+// which is 256 workers, 1024 requests in flight and SaturationBlock.
+// queueLimit is the maximum number of requests waiting by SaturationQueue,
+// 256 if not positive, as no request could ever wait otherwise.
+func SetFlowControl(maxWorkers, maxInflight int, policy string, queueLimit int) error {
+	switch policy {
+	case "":
+		policy = SaturationBlock
+	case SaturationBlock, SaturationShed, SaturationQueue:
+	default:
+		return fmt.Errorf("unknown saturation policy: %s", policy)
+	}
+	if maxWorkers <= 0 {
+		maxWorkers = 256
+	}
+	if maxInflight <= 0 {
+		maxInflight = 1024
+	}
+	if policy == SaturationQueue && queueLimit <= 0 {
+		queueLimit = defaultQueueLimit
+	}
+	workers = newLimiter(maxWorkers, policy, queueLimit)
+	outbound = newLimiter(maxInflight, policy, queueLimit)
+	return nil
+}
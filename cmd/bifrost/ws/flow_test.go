@@ -0,0 +1,174 @@
+package ws
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Wenchy/bifrost/internal/packet"
+)
+
+func TestCredit(t *testing.T) {
+	cr := newCredit(10)
+	if err := cr.take(10, nil); err != nil {
+		t.Fatalf("take() error = %v", err)
+	}
+	taken := make(chan error, 1)
+	go func() { taken <- cr.take(5, nil) }()
+	select {
+	case err := <-taken:
+		t.Fatalf("take() = %v before granted", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	cr.add(5)
+	if err := <-taken; err != nil {
+		t.Fatalf("take() error = %v", err)
+	}
+
+	done := make(chan struct{})
+	close(done)
+	if err := cr.take(1, done); err != errPipeDone {
+		t.Errorf("take() error = %v, want %v", err, errPipeDone)
+	}
+	cr.close()
+	if err := cr.take(1, nil); err != errConnClosed {
+		t.Errorf("take() error = %v, want %v", err, errConnClosed)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	for _, tt := range []struct {
+		policy     string
+		queueLimit int
+		want       []error // errors of acquiring 3 slots of 1
+	}{
+		{policy: SaturationBlock, want: []error{nil, errPipeDone, errPipeDone}},
+		{policy: SaturationShed, want: []error{nil, errSaturated, errSaturated}},
+		{policy: SaturationQueue, queueLimit: 1, want: []error{nil, errPipeDone, errSaturated}},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			l := newLimiter(1, tt.policy, tt.queueLimit)
+			done := make(chan struct{})
+			errs := make(chan error, len(tt.want))
+			if err := l.acquire(done); err != tt.want[0] {
+				t.Fatalf("acquire() error = %v, want %v", err, tt.want[0])
+			}
+			go func() { errs <- l.acquire(done) }()
+			// wait for the first waiter to be queued
+			time.Sleep(10 * time.Millisecond)
+			go func() { errs <- l.acquire(done) }()
+			time.Sleep(10 * time.Millisecond)
+			close(done)
+			got := map[error]int{}
+			for range tt.want[1:] {
+				got[<-errs]++
+			}
+			want := map[error]int{}
+			for _, err := range tt.want[1:] {
+				want[err]++
+			}
+			for err, n := range want {
+				if got[err] != n {
+					t.Errorf("acquire() errors = %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterStart(t *testing.T) {
+	for _, tt := range []struct {
+		policy     string
+		queueLimit int
+		want       []error // errors of starting 3 with 1 slot
+	}{
+		{policy: SaturationBlock, want: []error{nil, nil, nil}},
+		{policy: SaturationShed, want: []error{nil, errSaturated, errSaturated}},
+		{policy: SaturationQueue, queueLimit: 1, want: []error{nil, nil, errSaturated}},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			l := newLimiter(1, tt.policy, tt.queueLimit)
+			started := make(chan error, len(tt.want))
+			fn := func(err error) { started <- err }
+			canceled := make(chan struct{})
+			for i, want := range tt.want {
+				done := make(chan struct{})
+				if i == 1 {
+					done = canceled
+				}
+				if err := l.start(done, fn); err != want {
+					t.Fatalf("start() #%d error = %v, want %v", i, err, want)
+				}
+			}
+			if err := <-started; err != nil {
+				t.Fatalf("start() #0 called with %v", err)
+			}
+			select {
+			case err := <-started:
+				t.Fatalf("called with %v before released", err)
+			case <-time.After(10 * time.Millisecond):
+			}
+			// the canceled waiter is skipped, and the slot is handed over
+			close(canceled)
+			l.release()
+			got := map[error]int{}
+			for _, err := range tt.want[1:] {
+				if err == nil {
+					got[<-started]++
+				}
+			}
+			want := map[error]int{}
+			if tt.want[1] == nil {
+				want[errPipeDone]++
+			}
+			if tt.want[2] == nil {
+				want[nil]++
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("called with %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSetFlowControl(t *testing.T) {
+	defer SetFlowControl(0, 0, "", 0)
+	if err := SetFlowControl(0, 0, "unknown", 0); err == nil {
+		t.Errorf("SetFlowControl() of unknown policy succeeded")
+	}
+	for _, tt := range []struct {
+		policy     string
+		queueLimit int
+		want       int32
+	}{
+		{policy: SaturationQueue, queueLimit: 8, want: 8},
+		{policy: SaturationQueue, queueLimit: 0, want: defaultQueueLimit},
+		{policy: SaturationQueue, queueLimit: -1, want: defaultQueueLimit},
+		{policy: SaturationShed, queueLimit: 0, want: 0},
+	} {
+		if err := SetFlowControl(1, 1, tt.policy, tt.queueLimit); err != nil {
+			t.Fatalf("SetFlowControl() error = %v", err)
+		}
+		if workers.queueLimit != tt.want || outbound.queueLimit != tt.want {
+			t.Errorf("SetFlowControl(%s, %d) queue limits = %d, %d, want %d", tt.policy, tt.queueLimit, workers.queueLimit, outbound.queueLimit, tt.want)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	c := newLoopClient(1, "dc-east")
+	c.connCredit = newCredit(0)
+	key := streamKey{typ: packet.PacketTypeRequestBody, seq: 7}
+	c.openStreamCredit(key)
+	defer c.closeStreamCredit(key)
+	c.streamCredit(key.typ, key.seq).take(streamWindow, nil)
+
+	c.grant(key.typ, key.seq, 100)
+	c.handleWindow(sentPacket(t, c))
+	if n := c.streamCredit(key.typ, key.seq).n; n != 100 {
+		t.Errorf("stream credit = %d, want 100", n)
+	}
+	if n := c.connCredit.n; n != 100 {
+		t.Errorf("connection credit = %d, want 100", n)
+	}
+}
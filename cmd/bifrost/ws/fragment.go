@@ -0,0 +1,104 @@
+package ws
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Wenchy/bifrost/internal/atom"
+	"github.com/Wenchy/bifrost/internal/packet"
+)
+
+// Maximum message size allowed from peer, see SetMaxMessageSize. Packets
+// larger than the limit of either side are split into fragments.
+var maxMessageSize = 64 * 1024
+
+// Minimum of max message size, which must hold a header and a fair payload.
+const minMessageSize = 4 * 1024
+
+// Maximum bytes of fragments being reassembled on a connection, so that the
+// memory per connection is bounded.
+const maxReassemblySize = 16 * 1024 * 1024
+
+// errReassemblyLimit is returned when fragments being reassembled exceed
+// maxReassemblySize, which means the peer is misbehaving.
+var errReassemblyLimit = errors.New("reassembly limit exceeded")
+
+// SetMaxMessageSize sets the maximum message size allowed from peer, which
+// is exchanged when login, so that peers never send larger messages.
+func SetMaxMessageSize(size int) error {
+	if size == 0 {
+		return nil
+	}
+	if size < minMessageSize {
+		return fmt.Errorf("max message size %d less than %d", size, minMessageSize)
+	}
+	maxMessageSize = size
+	return nil
+}
+
+// streamKey identifies the packets of a request or response, e.g.: being
+// reassembled or flow controlled.
+type streamKey struct {
+	typ packet.PacketType
+	seq uint32
+}
+
+// messageLimit returns the maximum size of messages sent to the peer.
+func (c *Client) messageLimit() int {
+	if c.peerMaxMessageSize > 0 && c.peerMaxMessageSize < maxMessageSize {
+		return c.peerMaxMessageSize
+	}
+	return maxMessageSize
+}
+
+// fragment splits pkt into packets no larger than limit when encoded. All
+// but the last fragment are flagged with packet.FlagMoreFragments.
+func fragment(pkt *packet.Packet, limit int) []*packet.Packet {
+	size := limit - packet.HeaderSize
+	if len(pkt.Payload) <= size {
+		return []*packet.Packet{pkt}
+	}
+	var frags []*packet.Packet
+	for payload := pkt.Payload; len(payload) > 0; {
+		n := size
+		if n > len(payload) {
+			n = len(payload)
+		}
+		frag := &packet.Packet{Header: pkt.Header, Payload: payload[:n]}
+		frag.Header.Size = uint32(n)
+		payload = payload[n:]
+		if len(payload) > 0 {
+			frag.Header.Flags |= packet.FlagMoreFragments
+		}
+		frags = append(frags, frag)
+	}
+	return frags
+}
+
+// reassemble collects the fragments of a packet, and returns the whole packet
+// when its last fragment arrives, nil if more fragments are expected. It is
+// only called by the goroutine dispatching packets, and the fragments are
+// never touched by others, as a client is never reused for a new connection.
+func (c *Client) reassemble(pkt *packet.Packet) (*packet.Packet, error) {
+	key := streamKey{typ: pkt.Header.Type, seq: pkt.Header.Seq}
+	buf, ok := c.fragments[key]
+	more := pkt.Header.Flags&packet.FlagMoreFragments != 0
+	if !ok && !more {
+		return pkt, nil
+	}
+	c.fragmentBytes += len(pkt.Payload)
+	if c.fragmentBytes > maxReassemblySize {
+		return nil, errReassemblyLimit
+	}
+	buf = append(buf, pkt.Payload...)
+	if more {
+		c.fragments[key] = buf
+		return nil, nil
+	}
+	delete(c.fragments, key)
+	c.fragmentBytes -= len(buf)
+	atom.Log.Debugf("%v|%d|reassembled %d bytes", c.ID, pkt.Header.Seq, len(buf))
+	whole := &packet.Packet{Header: pkt.Header, Payload: buf}
+	whole.Header.Size = uint32(len(buf))
+	return whole, nil
+}
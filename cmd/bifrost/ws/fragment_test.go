@@ -0,0 +1,67 @@
+package ws
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Wenchy/bifrost/internal/packet"
+)
+
+func TestFragment(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 1000)
+	for _, tt := range []struct {
+		name      string
+		limit     int
+		wantFrags int
+	}{
+		{name: "not split", limit: packet.HeaderSize + len(payload), wantFrags: 1},
+		{name: "split evenly", limit: packet.HeaderSize + 1000, wantFrags: 10},
+		{name: "split with remainder", limit: packet.HeaderSize + 3000, wantFrags: 4},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newLoopClient(1, "dc-east")
+			pkt := packet.NewSeqPacket(packet.PacketTypeResponseBody, 3, payload)
+			frags := fragment(pkt, tt.limit)
+			if len(frags) != tt.wantFrags {
+				t.Fatalf("fragment() = %d fragments, want %d", len(frags), tt.wantFrags)
+			}
+			var got *packet.Packet
+			for i, frag := range frags {
+				buf, err := packet.Encode(frag)
+				if err != nil {
+					t.Fatalf("Encode() error = %v", err)
+				}
+				if len(buf) > tt.limit {
+					t.Errorf("fragment %d size = %d, exceeds %d", i, len(buf), tt.limit)
+				}
+				got, err = c.reassemble(frag)
+				if err != nil {
+					t.Fatalf("reassemble() error = %v", err)
+				}
+				if (got != nil) != (i == len(frags)-1) {
+					t.Fatalf("reassemble() of fragment %d = %v", i, got)
+				}
+			}
+			if !bytes.Equal(got.Payload, payload) || int(got.Header.Size) != len(payload) {
+				t.Errorf("reassembled payload mismatch, size = %d", got.Header.Size)
+			}
+			if c.fragmentBytes != 0 || len(c.fragments) != 0 {
+				t.Errorf("fragments left: %d bytes", c.fragmentBytes)
+			}
+		})
+	}
+}
+
+func TestReassemblyLimit(t *testing.T) {
+	c := newLoopClient(1, "dc-east")
+	frag := packet.NewSeqPacket(packet.PacketTypeRequestBody, 1, make([]byte, maxMessageSize))
+	frag.Header.Flags |= packet.FlagMoreFragments
+	for i := 0; i < maxReassemblySize/maxMessageSize; i++ {
+		if _, err := c.reassemble(frag); err != nil {
+			t.Fatalf("reassemble() error = %v", err)
+		}
+	}
+	if _, err := c.reassemble(frag); err != errReassemblyLimit {
+		t.Errorf("reassemble() error = %v, want %v", err, errReassemblyLimit)
+	}
+}
@@ -0,0 +1,116 @@
+package ws
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Wenchy/bifrost/internal/packet"
+)
+
+var dispatchOnce sync.Once
+
+// newLoopClient returns a client without connection, whose sent packets can
+// be read by sentPacket and handled by itself.
+func newLoopClient(id uint64, name string) *Client {
+	c := newClient(nil, "")
+	c.ID = id
+	c.Name = name
+	c.Capabilities = packet.Capabilities
+	c.session = newSession(testKeyring, testKeyring, defaultCodec)
+	return c
+}
+
+// sentPacket returns the next packet sent by c, which is sealed as written.
+func sentPacket(t *testing.T, c *Client) *packet.Packet {
+	t.Helper()
+	bufs, err := c.encode(<-c.sendCh)
+	if err != nil {
+		t.Fatalf("encode() error = %v", err)
+	}
+	pkt, err := packet.Parse(bufs[0])
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	return pkt
+}
+
+// dialPair dials a connection to a test server, and returns the dialing
+// side with packets of both sides dispatched by Hub.
+func dialPair(t *testing.T) *Client {
+	dispatchOnce.Do(func() { go Hub.dispatchIngress() })
+	srv := httptest.NewServer(http.HandlerFunc(ServeWS))
+	t.Cleanup(srv.Close)
+	c, err := Dial("ws://"+strings.TrimPrefix(srv.URL, "http://")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	c.Run()
+	t.Cleanup(func() { c.conn.Close() })
+	return c
+}
+
+// dialPeer dials a pair like dialPair with both sides named name, so that
+// requests through the peer of name never pick clients left by other tests.
+func dialPeer(t *testing.T, name string) *Client {
+	SetIdentity(name, "")
+	defer SetIdentity("", "")
+	return dialPair(t)
+}
+
+// forwardServer serves requests by forwarding them to target through the
+// peer of name.
+func forwardServer(t *testing.T, target, peer string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		Forward(target, peer, rw, req)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// echoServer listens on a local port echoing what is read until EOF, and
+// returns the address. The connections are closed and waited for on cleanup.
+func echoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+		wg    sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+	return ln.Addr().String()
+}
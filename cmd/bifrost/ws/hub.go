@@ -3,14 +3,17 @@ package ws
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Wenchy/bifrost/internal/atom"
@@ -19,16 +22,40 @@ import (
 
 var Hub *hub
 
+// Default timeout of a request, see SetRequestTimeout.
+var requestTimeout = 5 * time.Second
+
+// Max times to retry a request when its connection is closed.
+const maxRetries = 2
+
 func init() {
 	Hub = NewDefaultHub()
 }
 
+// SetRequestTimeout sets the default timeout of a request forwarded through
+// the tunnel, which is overridden by HTTP header "X-Bifrost-Timeout".
+func SetRequestTimeout(timeout time.Duration) {
+	requestTimeout = timeout
+}
+
+// Balance policies to pick a client for a request.
+const (
+	BalanceRoundRobin    = "round_robin"    // pick clients in turn
+	BalanceLeastInflight = "least_inflight" // pick the client with the fewest requests waiting for response
+)
+
 // hub maintains the set of active clients and Broadcasts messages to the
 // clients.
 type hub struct {
 	sync.RWMutex
 	// Registered clients.
 	Clients map[uint64]*Client
+	// Registered clients in the order of registration, for balancing.
+	list []*Client
+	// balance policy
+	balance string
+	// next index of list to pick by round robin
+	next uint32
 
 	// Inbound messages from the clients.
 	ingress chan Messager
@@ -37,21 +64,48 @@ type hub struct {
 func NewDefaultHub() *hub {
 	return &hub{
 		Clients: make(map[uint64]*Client),
+		balance: BalanceRoundRobin,
 		ingress: make(chan Messager, 1024),
 	}
 }
 
+// SetBalance sets the policy to pick a client for a request, empty means
+// BalanceRoundRobin.
+func (h *hub) SetBalance(balance string) error {
+	switch balance {
+	case "":
+		balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastInflight:
+	default:
+		return fmt.Errorf("unknown balance policy: %s", balance)
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.balance = balance
+	return nil
+}
+
 func (h *hub) Run() {
 	go h.dispatchIngress()
 	statTicker := time.NewTicker(10 * time.Second)
+	pingTicker := time.NewTicker(pingNoticePeriod)
 	defer func() {
 		statTicker.Stop()
+		pingTicker.Stop()
 	}()
 
 	for {
 		select {
 		case <-statTicker.C:
-			atom.Log.Infof("client count: %d", len(h.Clients))
+			h.RLock()
+			atom.Log.Infof("client count: %d, replays: %d", len(h.Clients), atomic.LoadUint64(&replayCount))
+			h.RUnlock()
+		case <-pingTicker.C:
+			h.RLock()
+			for _, c := range h.list {
+				go c.ping()
+			}
+			h.RUnlock()
 		}
 	}
 }
@@ -61,26 +115,236 @@ func (h *hub) register(c *Client) {
 	defer h.Unlock()
 
 	h.Clients[c.ID] = c
-	atom.Log.Debugf("%v|register client: %p", c.ID, c)
+	h.list = append(h.list, c)
+	atom.Log.Debugf("%v|register client: %p, name: %s, subject: %s", c.ID, c, c.Name, c.Subject)
+}
+
+// checkName checks the name presented by a peer logging in against the
+// connected clients. A name is only shared by the pooled connections of a
+// peer, which present the same instance ID.
+func (h *hub) checkName(name, instance string) error {
+	if name == "" {
+		return nil
+	}
+	h.RLock()
+	defer h.RUnlock()
+	for _, c := range h.list {
+		if c.Name == name && c.instance != instance {
+			return fmt.Errorf("name %s in use by another peer", name)
+		}
+	}
+	return nil
 }
 
+// unregister removes c and closes it. Clients are found by pointer, as both
+// sides of a connection to itself share the same ID.
 func (h *hub) unregister(c *Client) {
 	h.Lock()
 	defer h.Unlock()
-	// TODO: optimize performance
-	for id := range h.Clients {
-		if c.ID == id {
-			delete(h.Clients, c.ID)
+	for i, client := range h.list {
+		if client == c {
+			h.list = append(h.list[:i], h.list[i+1:]...)
+			if h.Clients[c.ID] == c {
+				delete(h.Clients, c.ID)
+			}
 			c.close()
+			unlisten(c)
 			return
 		}
 	}
-	atom.Log.Warnf("%v|unregister client: %p, ID not found when unregister", c.ID, c)
+	atom.Log.Warnf("%v|unregister client: %p, not found when unregister", c.ID, c)
+}
+
+// pick picks a client connected to the peer of name to send a request to
+// host by the balance policy. If name is empty, any peer can be picked, and
+// the peers announcing host as a route are preferred. Draining clients are
+// never picked. The error is a *tunnelError of errCodePeerOffline if the peer
+// of name is not connected, or errCodeNoPeer if no peer is.
+func (h *hub) pick(name, host string) (*Client, error) {
+	h.RLock()
+	defer h.RUnlock()
+
+	var candidates, routed []*Client
+	for _, c := range h.list {
+		if name != "" && c.Name != name {
+			continue
+		}
+		if atomic.LoadInt32(&c.draining) != 0 {
+			continue
+		}
+		candidates = append(candidates, c)
+		if name == "" && host != "" && c.routesTo(host) {
+			routed = append(routed, c)
+		}
+	}
+	if len(routed) != 0 {
+		candidates = routed
+	}
+	if len(candidates) == 0 {
+		if name != "" {
+			return nil, &tunnelError{code: errCodePeerOffline, msg: "peer " + name + " is offline"}
+		}
+		return nil, &tunnelError{code: errCodeNoPeer, msg: "no peer connected"}
+	}
+	switch h.balance {
+	case BalanceLeastInflight:
+		picked := candidates[0]
+		for _, c := range candidates[1:] {
+			if atomic.LoadInt32(&c.inflight) < atomic.LoadInt32(&picked.inflight) {
+				picked = c
+			}
+		}
+		return picked, nil
+	default:
+		next := atomic.AddUint32(&h.next, 1)
+		return candidates[int(next)%len(candidates)], nil
+	}
 }
 
+// dispatchIngress dispatches messages in the order they are received, so the
+// packets of a request are also handled in order.
 func (h *hub) dispatchIngress() {
 	for messager := range h.ingress {
-		go h.handleIngress(messager.client, messager.msg)
+		h.dispatch(messager.client, messager.msg)
+	}
+}
+
+// dispatch routes the packets batched in msg in order.
+func (h *hub) dispatch(c *Client, msg []byte) {
+	pkts, err := packet.ParseAll(msg)
+	for _, pkt := range pkts {
+		h.dispatchPacket(c, pkt)
+	}
+	if err != nil {
+		atom.Log.Warnf("%v|decode err: %v", c.ID, err)
+		if _, ok := err.(*packet.VersionError); ok {
+			rejectConn(c.conn, err)
+		}
+	}
+}
+
+// dispatchPacket routes a packet to the goroutine handling its request. A new
+// goroutine is started for each request once a worker is taken.
+func (h *hub) dispatchPacket(c *Client, pkt *packet.Packet) {
+	var err error
+	atom.Log.Debugf("packet seq: %v, type: %v", pkt.Header.Seq, pkt.Header.Type)
+	if pkt.Header.ID != c.ID {
+		atom.Log.Warnf("%v|packet ID mismatch: %v", c.ID, pkt.Header.ID)
+		return
+	}
+	pkt, err = c.reassemble(pkt)
+	if err != nil {
+		atom.Log.Errorf("%v|reassemble failed: %v", c.ID, err)
+		rejectConn(c.conn, err)
+		return
+	}
+	if pkt == nil {
+		// more fragments are expected
+		return
+	}
+	// payloads are opened here in the order received, and consumers only
+	// decompress them. Every packet after login is sealed, even without
+	// payload, so packets not encrypted are rejected.
+	if pkt.Header.Flags&packet.FlagEncrypted == 0 {
+		err = errNotEncrypted
+	} else {
+		err = c.session.open(pkt)
+	}
+	if err != nil {
+		atom.Log.Warnf("%v|%d|open packet of type %v failed: %v", c.ID, pkt.Header.Seq, pkt.Header.Type, err)
+		c.failPacket(pkt, err)
+		return
+	}
+
+	switch pkt.Header.Type {
+	case packet.PacketTypeRequest:
+		in := c.newInbound(pkt.Header.Seq)
+		if in == nil {
+			atom.Log.Warnf("%v|%d|seq collision of inbound request", c.ID, pkt.Header.Seq)
+			c.sendError(pkt.Header.Seq, errCodeInternal, errSeqInUse.Error())
+			return
+		}
+		// a worker is taken before starting a goroutine for the request, so
+		// that requests waiting for workers cost no goroutine
+		seq := pkt.Header.Seq
+		err := workers.start(in.ctx.Done(), func(err error) {
+			defer c.removeInbound(seq)
+			if err != nil {
+				in.cancel()
+				in.body.Close()
+				return
+			}
+			defer workers.release()
+			atomic.StoreInt32(&in.waiting, 0)
+			h.handleRequest(c, pkt, in)
+		})
+		if err != nil {
+			atom.Log.Warnf("%v|%d|shed inbound request: %v", c.ID, seq, err)
+			c.removeInbound(seq)
+			in.cancel()
+			in.body.Close()
+			// never block the dispatcher
+			go c.sendError(seq, errCodeOverloaded, err.Error())
+		}
+	case packet.PacketTypeRequestBody, packet.PacketTypeRequestEnd:
+		in := c.getInbound(pkt.Header.Seq)
+		if in == nil || !in.push(pkt) {
+			atom.Log.Warnf("%v|inbound request not found by packet seq, or its pipe is full", pkt.Header.Seq)
+			c.grantDropped(pkt)
+		}
+	case packet.PacketTypeWindow:
+		c.handleWindow(pkt)
+	case packet.PacketTypeStreamOpen, packet.PacketTypeStreamData, packet.PacketTypeStreamClose, packet.PacketTypeStreamReset:
+		c.handleStreamPacket(pkt)
+	case packet.PacketTypeCancel:
+		in := c.getInbound(pkt.Header.Seq)
+		if in == nil {
+			atom.Log.Debugf("%v|inbound request to cancel not found, maybe finished", pkt.Header.Seq)
+			return
+		}
+		atom.Log.Infof("%v|inbound request canceled by peer", pkt.Header.Seq)
+		in.cancel()
+	case packet.PacketTypeResponse, packet.PacketTypeResponseBody, packet.PacketTypeResponseEnd:
+		rsper := c.getResponser(pkt.Header.Seq)
+		if rsper == nil || !rsper.pipe.push(pkt) {
+			atom.Log.Warnf("%v|responser not found by packet seq, or its pipe is full", pkt.Header.Seq)
+			c.grantDropped(pkt)
+		}
+	case packet.PacketTypeNotice:
+		h.handleNotice(c, pkt)
+	default:
+		atom.Log.Errorf("unknown packet type: %v", pkt.Header.Type)
+	}
+}
+
+// failPacket fails the request or stream of pkt which can not be opened, so
+// that its body is not silently truncated.
+func (c *Client) failPacket(pkt *packet.Packet, err error) {
+	seq := pkt.Header.Seq
+	switch pkt.Header.Type {
+	case packet.PacketTypeRequest:
+		if err != errReplay {
+			c.sendError(seq, errCodeDecode, err.Error())
+		}
+	case packet.PacketTypeRequestBody, packet.PacketTypeRequestEnd:
+		if in := c.getInbound(seq); in != nil {
+			in.body.pipe.abort(err)
+		}
+		c.grantDropped(pkt)
+	case packet.PacketTypeResponse, packet.PacketTypeResponseBody, packet.PacketTypeResponseEnd:
+		if rsper := c.getResponser(seq); rsper != nil {
+			rsper.pipe.abort(&tunnelError{code: errCodeDecode, msg: err.Error()})
+		}
+		c.grantDropped(pkt)
+	case packet.PacketTypeStreamOpen:
+		if err != errReplay {
+			c.resetStream(seq, errCodeDecode, err.Error())
+		}
+	case packet.PacketTypeStreamData, packet.PacketTypeStreamClose:
+		if s := c.getStream(seq); s != nil {
+			s.reset(errCodeDecode, err.Error())
+		}
+		c.grantDropped(pkt)
 	}
 }
 
@@ -155,173 +419,114 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
-func (h *hub) handleIngress(c *Client, msg []byte) error {
-	pkt, err := packet.Parse(msg)
+// handleRequest sends the request streamed from the peer to its target, and
+// streams the response back.
+func (h *hub) handleRequest(c *Client, pkt *packet.Packet, in *inbound) error {
+	defer in.cancel()
+	defer in.body.Close()
+	// https://stackoverflow.com/questions/19595860/http-request-requesturi-field-when-making-request-in-go
+	rawReq, err := c.session.unseal(pkt)
 	if err != nil {
-		atom.Log.Warnf("decode err: %v", err)
+		c.sendError(pkt.Header.Seq, errCodeDecode, err.Error())
 		return err
 	}
-	atom.Log.Debugf("packet seq: %v", pkt.Header.Seq)
 
-	switch pkt.Header.Type {
-	case packet.PacketTypeRequest:
-		// https://stackoverflow.com/questions/19595860/http-request-requesturi-field-when-making-request-in-go
-		// decompress payload
-
-		// decrypt
-		zipReq, err := Decrypt(cipherKey, pkt.Payload)
-		if err != nil {
-			atom.Log.Errorf("decrypt failed: %s", err)
-			return err
-		}
-		// decompress
-		rawReq, err := DecompressByGzip(zipReq)
-		if err != nil {
-			atom.Log.Errorf("decompress failed: %s", err)
-			return err
-		}
-
-		req, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(rawReq)))
-		if err != nil {
-			atom.Log.Errorf("ReadRequest failed: %v", err)
-			return err
-		}
-
-		target := req.Header.Get("X-Bifrost-Target")
-		timeout := time.Second * 5
-		t := req.Header.Get("X-Bifrost-Timeout")
-		if t != "" {
-			v, err := strconv.ParseInt(t, 10, 64)
-			if err != nil {
-				atom.Log.Errorf("got %s, parse int failed:%+v", t, err)
-			} else {
-				timeout = time.Duration(v) * time.Second
-			}
-		}
-		targetURL, err := url.Parse(target)
-		if err != nil {
-			atom.Log.Errorf("%s|parse url failed:%+v", target, err)
-			return err
-		}
-		DirectRequest(req, targetURL)
-
-		// Save a copy of this request for debugging.
-		logRawReq, err := httputil.DumpRequest(req, true)
-		if err != nil {
-			atom.Log.Errorf("DumpRequest failed: %s", err)
-			return err
-		}
-
-		atom.Log.Debugf("%d|recieve request: %s, %s, %s", pkt.Header.Seq, req.Method, req.URL.String(), string(logRawReq))
-
-		client := &http.Client{
-			Timeout: timeout,
-			// NOTE(wenchy): shouldn't follow any redirects!!!
-			//
-			// As a special case, if CheckRedirect returns ErrUseLastResponse,
-			// then the most recent response is returned with its body
-			// unclosed, along with a nil error.
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
-		}
-		rsp, err := client.Do(req)
-		if err != nil {
-			atom.Log.Errorf("http client do failed: %v", err)
-			rsp = &http.Response{
-				StatusCode: http.StatusInternalServerError,
-				Status:     err.Error(),
-				ProtoMajor: 1,
-				ProtoMinor: 1,
-			}
-		}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(rawReq)))
+	if err != nil {
+		atom.Log.Errorf("ReadRequest failed: %v", err)
+		c.sendError(pkt.Header.Seq, errCodeDecode, err.Error())
+		return err
+	}
+	// the body follows as body chunk packets
+	if req.ContentLength == 0 && len(req.TransferEncoding) == 0 {
+		req.Body = http.NoBody
+	} else {
+		req.Body = in.body
+	}
+	req = req.WithContext(in.ctx)
 
-		// Save a copy of this request for debugging.
-		rawRsp, err := httputil.DumpResponse(rsp, true)
+	target := req.Header.Get("X-Bifrost-Target")
+	timeout := requestTimeout
+	t := req.Header.Get("X-Bifrost-Timeout")
+	if t != "" {
+		v, err := strconv.ParseInt(t, 10, 64)
 		if err != nil {
-			atom.Log.Errorf("DumpRequest failed: %s", err)
-			return err
+			atom.Log.Errorf("got %s, parse int failed:%+v", t, err)
+		} else {
+			timeout = time.Duration(v) * time.Second
 		}
+	}
+	targetURL, err := url.Parse(target)
+	if err == nil && targetURL.Scheme != "http" && targetURL.Scheme != "https" {
+		err = fmt.Errorf("unsupported target: %q", target)
+	}
+	if err != nil {
+		atom.Log.Errorf("%s|parse url failed:%+v", target, err)
+		c.sendError(pkt.Header.Seq, errCodeRouteDenied, err.Error())
+		return err
+	}
+	DirectRequest(req, targetURL)
 
-		atom.Log.Debugf("%d|got response: %s, %s, %s", pkt.Header.Seq, req.Method, req.URL.String(), string(rawRsp))
-
-		h.RLock()
-		c, ok := h.Clients[0] // TODO: pick a proper client
-		if !ok {
-			h.RUnlock()
-			atom.Log.Warnf("client 0 not found")
-			return fmt.Errorf("client 0 not found")
-		}
-		h.RUnlock()
+	// Save a copy of this request for debugging.
+	logRawReq, err := httputil.DumpRequest(req, false)
+	if err != nil {
+		atom.Log.Errorf("DumpRequest failed: %s", err)
+		return err
+	}
 
-		// compress
-		zipRsp, err := CompressByGzip(rawRsp)
-		if err != nil {
-			atom.Log.Errorf("compress failed: %s", err)
-			return err
-		}
-		// encrypt
-		cipherRsp, err := Encrypt(cipherKey, zipRsp)
-		if err != nil {
-			atom.Log.Errorf("encrypt failed: %s", err)
+	atom.Log.Debugf("%d|recieve request: %s, %s, %s", pkt.Header.Seq, req.Method, req.URL.String(), string(logRawReq))
+
+	client := &http.Client{
+		Timeout: timeout,
+		// NOTE(wenchy): shouldn't follow any redirects!!!
+		//
+		// As a special case, if CheckRedirect returns ErrUseLastResponse,
+		// then the most recent response is returned with its body
+		// unclosed, along with a nil error.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		atom.Log.Errorf("http client do failed: %v", err)
+		if in.ctx.Err() == context.Canceled {
+			// canceled by the peer, which is not waiting for the response
 			return err
 		}
+		c.sendError(pkt.Header.Seq, errorCode(err), err.Error())
+		return err
+	}
+	defer rsp.Body.Close()
 
-		pkt.Header.Type = packet.PacketTypeResponse
-		pkt.Header.Size = uint32(len(cipherRsp))
-		pkt.Payload = cipherRsp
-		c.SendPacket(pkt, nil)
-
-		atom.Log.Debugf("%d|send response: %s", pkt.Header.Seq, rawRsp)
+	// the body follows as body chunk packets
+	rawRsp, err := httputil.DumpResponse(rsp, false)
+	if err != nil {
+		atom.Log.Errorf("DumpResponse failed: %s", err)
+		return err
+	}
 
-	case packet.PacketTypeResponse:
-		rsper := c.getResponser(pkt.Header.Seq)
-		if rsper == nil {
-			atom.Log.Warnf("%v|responser not found by packet seq", pkt.Header.Seq)
-			return fmt.Errorf("responser not found")
-		}
-		// decrypt
-		zipRsp, err := Decrypt(cipherKey, pkt.Payload)
-		if err != nil {
-			atom.Log.Errorf("decrypt failed: %s", err)
-			return err
-		}
-		// decompress
-		rawRsp, err := DecompressByGzip(zipRsp)
-		if err != nil {
-			atom.Log.Errorf("decompress failed: %s", err)
-			return err
-		}
+	atom.Log.Debugf("%d|got response: %s, %s, %s", pkt.Header.Seq, req.Method, req.URL.String(), string(rawRsp))
 
-		atom.Log.Debugf("%d|recieve response: %s", pkt.Header.Seq, string(rawRsp))
-		// refer: https://stackoverflow.com/questions/62387069/golang-parse-raw-http-2-response
-		// TODO(wenchy): handle HTTP/2
-		rsp, err := http.ReadResponse(bufio.NewReader(bytes.NewBuffer(rawRsp)), rsper.req)
-		if err != nil {
-			atom.Log.Errorf("ReadResponse failed: %v", err)
-			return err
-		}
-		// Read body to buffer
-		body, err := ioutil.ReadAll(rsp.Body)
-		if err != nil {
-			atom.Log.Errorf("Error reading body: %v", err)
-			panic(err)
-		}
-		defer rsp.Body.Close()
+	// the response is sent back on the connection the request came in on
+	rspPkt := packet.NewSeqPacket(packet.PacketTypeResponse, pkt.Header.Seq, nil)
+	if err := c.sendSealed(rspPkt, rawRsp, true); err != nil {
+		atom.Log.Errorf("SendPacket failed: %s", err)
+		return err
+	}
+	atom.Log.Debugf("%d|send response: %s", pkt.Header.Seq, rawRsp)
 
-		copyHeader(rsper.rw.Header(), rsp.Header)
-		// NOTE(wenchyzhu): read docs of http.ResponseWriter and refer net/http/httputil/reverseproxy.go
-		// Changing the header map after a call to WriteHeader (or
-		// Write) has no effect unless the modified headers are
-		// trailers.
-		rsper.rw.WriteHeader(rsp.StatusCode)
-		rsper.rw.Write(body)
-		rsper.done <- true
+	return c.sendBody(packet.PacketTypeResponseBody, packet.PacketTypeResponseEnd, pkt.Header.Seq, rsp.Body, compressible(rsp.Header), in.ctx.Done())
+}
 
-	case packet.PacketTypeNotice:
-		atom.Log.Errorf("PacketTypeNotice not processed currently")
-	default:
-		atom.Log.Errorf("unknown packet type: %v", pkt.Header.Type)
+// sendError responds the request of seq with a tunnel error, instead of the
+// response of target.
+func (c *Client) sendError(seq uint32, code errCode, msg string) error {
+	pkt := packet.NewSeqPacket(packet.PacketTypeResponse, seq, nil)
+	pkt.Header.Code = int32(code)
+	if err := c.sendSealed(pkt, []byte(msg), true); err != nil {
+		atom.Log.Errorf("%d|send error failed: %s", seq, err)
+		return err
 	}
 	return nil
 }
@@ -335,72 +540,231 @@ func (h *hub) forward(ID uint64, msg []byte) error {
 		return fmt.Errorf("ID not found")
 	}
 
-	c.send(msg)
-	return nil
+	pkt, err := packet.Parse(msg)
+	if err != nil {
+		return err
+	}
+	return c.SendPacket(pkt, nil)
 }
 
-func Forward(target string, rw http.ResponseWriter, req *http.Request) {
-	err := doForward(target, rw, req)
+// Forward forwards req to target through the peer of name, any peer if empty.
+func Forward(target, peer string, rw http.ResponseWriter, req *http.Request) {
+	err := doForward(target, peer, rw, req)
 	if err != nil {
 		atom.Log.Errorf("do forward failed: %+v", err)
-		rw.WriteHeader(http.StatusBadGateway)
 	}
 }
 
-func doForward(target string, rw http.ResponseWriter, req *http.Request) error {
-	Hub.RLock()
-	c, ok := Hub.Clients[0] // TODO: pick a proper client
-	if !ok {
-		Hub.RUnlock()
-		atom.Log.Warnf("%v|ID not found", 0)
-		return fmt.Errorf("ID %d not found", 0)
+// targetHost returns the host of target URL, empty if invalid.
+func targetHost(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
 	}
-	Hub.RUnlock()
+	return u.Host
+}
+
+func doForward(target, peer string, rw http.ResponseWriter, req *http.Request) error {
 	// custom HTTP header field: X-Bifrost-Target
 	req.Header.Set("X-Bifrost-Target", target)
-	// Save a copy of this request for debugging.
-	rawReq, err := httputil.DumpRequest(req, true)
+	// custom HTTP header field: X-Bifrost-Timeout, which is also used by the
+	// peer as timeout of requesting the target.
+	timeout := requestTimeout
+	if t := req.Header.Get("X-Bifrost-Timeout"); t != "" {
+		v, err := strconv.ParseInt(t, 10, 64)
+		if err != nil || v <= 0 {
+			atom.Log.Errorf("got %s, parse int failed:%+v", t, err)
+		} else {
+			timeout = time.Duration(v) * time.Second
+		}
+	}
+	req.Header.Set("X-Bifrost-Timeout", strconv.FormatInt(int64(timeout/time.Second), 10))
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+
+	// Save a copy of this request for debugging, the body follows as body
+	// chunk packets.
+	rawReq, err := httputil.DumpRequest(req, false)
 	if err != nil {
 		atom.Log.Errorf("DumpRequest failed: %s", err)
+		writeError(rw, errCodeInternal, err.Error())
 		return err
 	}
 
-	// compress
-	zipReq, err := CompressByGzip(rawReq)
+	if err := outbound.acquire(ctx.Done()); err != nil {
+		atom.Log.Warnf("acquire outbound slot failed: %v", err)
+		switch {
+		case err == errSaturated:
+			writeError(rw, errCodeOverloaded, err.Error())
+		case ctx.Err() == context.DeadlineExceeded:
+			writeError(rw, errCodeTimeout, "request timeout")
+		}
+		return err
+	}
+	defer outbound.release()
+
+	for retries := 0; ; retries++ {
+		c, err := Hub.pick(peer, targetHost(target))
+		if err != nil {
+			atom.Log.Warnf("pick client failed: %v", err)
+			te := err.(*tunnelError)
+			writeError(rw, te.code, te.msg)
+			return err
+		}
+		rsper := newResponser(c, req, rw)
+		err = c.roundTrip(ctx, rawReq, rsper)
+		if err == nil {
+			atom.Log.Debugf("%v|end request: %s", c.ID, req.URL.String())
+			return nil
+		}
+		if ctx.Err() != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				atom.Log.Warnf("%v|request timeout after %v: %s", c.ID, timeout, req.URL.String())
+				rsper.fail(errCodeTimeout, "request timeout")
+				return ctx.Err()
+			}
+			atom.Log.Infof("%v|request canceled: %s", c.ID, req.URL.String())
+			return nil
+		}
+		if err == errConnClosed && !rsper.wroteHeader && retries < maxRetries && isRetryable(req) {
+			atom.Log.Warnf("%v|connection closed, retry request on another connection: %s", c.ID, req.URL.String())
+			continue
+		}
+		atom.Log.Errorf("%v|serve response failed: %s", c.ID, err)
+		var te *tunnelError
+		switch {
+		case errors.As(err, &te):
+			rsper.fail(te.code, te.msg)
+		case err == errConnClosed:
+			rsper.fail(errCodeConnClosed, err.Error())
+		default:
+			rsper.fail(errCodeInternal, err.Error())
+		}
+		return err
+	}
+}
+
+// roundTrip sends the request of rawReq with its body to the peer, and
+// serves the response by rsper. If ctx is done before the response is
+// finished, the peer is told to abort the request.
+func (c *Client) roundTrip(ctx context.Context, rawReq []byte, rsper *Responser) error {
+	atomic.AddInt32(&c.inflight, 1)
+	defer atomic.AddInt32(&c.inflight, -1)
+
+	pkt := packet.NewSeqPacket(packet.PacketTypeRequest, 0, nil)
+	f, err := c.session.frame(pkt, rawReq, true)
 	if err != nil {
-		atom.Log.Errorf("compress failed: %s", err)
 		return err
 	}
-	// encrypt
-	cipherReq, err := Encrypt(cipherKey, zipReq)
+	// allocate another seq if collided after wraparound
+	seq := c.nextSeq()
+	pkt.Header.Seq = seq
+	err = c.sendFrame(f, rsper)
+	for err == errSeqInUse {
+		seq = c.nextSeq()
+		pkt.Header.Seq = seq
+		err = c.sendFrame(f, rsper)
+	}
+	defer c.removeResponser(seq)
 	if err != nil {
-		atom.Log.Errorf("encrypt failed: %s", err)
+		atom.Log.Errorf("SendPacket failed: %s", err)
 		return err
 	}
+	atom.Log.Debugf("%d|send request: %s", seq, rsper.req.URL.String())
+	err = c.sendBody(packet.PacketTypeRequestBody, packet.PacketTypeRequestEnd, seq, rsper.req.Body, compressible(rsper.req.Header), ctx.Done())
+	if err == nil {
+		err = rsper.serve(ctx, c)
+	}
+	if err != nil && ctx.Err() != nil {
+		// tell the peer to abort requesting the target
+		if err := c.sendSealed(packet.NewSeqPacket(packet.PacketTypeCancel, seq, nil), nil, false); err != nil {
+			atom.Log.Warnf("%d|send cancel failed: %s", seq, err)
+		}
+	}
+	return err
+}
+
+// isRetryable reports whether req can be sent again on another connection
+// after the connection it was sent on is closed. Only idempotent requests
+// without body are retryable, as the body has been consumed.
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return req.ContentLength == 0 && len(req.TransferEncoding) == 0
+	default:
+		return false
+	}
+}
 
-	pkt := packet.NewRequestPacket(cipherReq)
-	rsper := &Responser{
-		done: make(chan bool),
-		req:  req,
-		rw:   rw,
+// fail responds the tunnel error of code to the request if no response
+// header has been written yet.
+func (r *Responser) fail(code errCode, msg string) {
+	if r.wroteHeader {
+		return
 	}
+	r.wroteHeader = true
+	writeError(r.rw, code, msg)
+}
 
-	atom.Log.Debugf("%d|send request: %s, %s", pkt.Header.Seq, req.URL.String(), string(rawReq))
+// writeError responds the tunnel error of code, with its name in the
+// "X-Bifrost-Error" header.
+func writeError(rw http.ResponseWriter, code errCode, msg string) {
+	rw.Header().Set(errorHeader, code.String())
+	http.Error(rw, "bifrost: "+msg, code.status())
+}
 
-	err = c.SendPacket(pkt, rsper)
+// serve writes the response streamed from the peer to rw, flushing each body
+// chunk as it arrives. Packets are decrypted by the session of c, which the
+// credit of body chunks is granted back to. It stops waiting when ctx is done.
+func (r *Responser) serve(ctx context.Context, c *Client) error {
+	pkt, err := r.pipe.pop(ctx.Done())
 	if err != nil {
-		atom.Log.Errorf("SendPacket failed: %s", err)
 		return err
 	}
+	if pkt.Header.Type != packet.PacketTypeResponse {
+		return fmt.Errorf("unexpected packet type: %v", pkt.Header.Type)
+	}
+	rawRsp, err := c.session.unseal(pkt)
+	if err != nil {
+		return &tunnelError{code: errCodeDecode, msg: err.Error()}
+	}
+	if pkt.Header.Code != 0 {
+		return &tunnelError{code: errCode(pkt.Header.Code), msg: string(rawRsp)}
+	}
 
+	atom.Log.Debugf("%d|recieve response: %s", pkt.Header.Seq, string(rawRsp))
+	// refer: https://stackoverflow.com/questions/62387069/golang-parse-raw-http-2-response
+	// TODO(wenchy): handle HTTP/2
+	rsp, err := http.ReadResponse(bufio.NewReader(bytes.NewBuffer(rawRsp)), r.req)
+	if err != nil {
+		atom.Log.Errorf("ReadResponse failed: %v", err)
+		return &tunnelError{code: errCodeDecode, msg: err.Error()}
+	}
+
+	copyHeader(r.rw.Header(), rsp.Header)
+	// NOTE(wenchyzhu): read docs of http.ResponseWriter and refer net/http/httputil/reverseproxy.go
+	// Changing the header map after a call to WriteHeader (or
+	// Write) has no effect unless the modified headers are
+	// trailers.
+	r.rw.WriteHeader(rsp.StatusCode)
+	r.wroteHeader = true
+
+	flusher, _ := r.rw.(http.Flusher)
+	body := newBodyReader(r.pipe, c, packet.PacketTypeResponseBody, pkt.Header.Seq, ctx.Done)
+	defer body.Close()
 	for {
-		select {
-		case <-rsper.done:
-			atom.Log.Debugf("%d|end request: %s", pkt.Header.Seq, req.URL.String())
-			// atom.Log.Debugf("%d|end request: %s", pkt.Header.Seq, string(rawReq))
+		chunk, err := body.next()
+		if err == io.EOF {
 			return nil
 		}
+		if err != nil {
+			return err
+		}
+		if _, err := r.rw.Write(chunk); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
 	}
 }
-
-
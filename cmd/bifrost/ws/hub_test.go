@@ -0,0 +1,228 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// peerOf returns the accepting side of the pair dialed by c, which is
+// registered once it has read the key confirmation after c logged in.
+func peerOf(t *testing.T, c *Client) *Client {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		Hub.RLock()
+		for _, peer := range Hub.list {
+			if peer.ID == c.ID && peer != c {
+				Hub.RUnlock()
+				return peer
+			}
+		}
+		Hub.RUnlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("peer of client %v not found", c.ID)
+	return nil
+}
+
+// waitIdle waits until no request is left in the maps of c.
+func waitIdle(t *testing.T, c *Client) {
+	t.Helper()
+	var responsers, requests int
+	for i := 0; i < 100; i++ {
+		c.RLock()
+		responsers, requests = len(c.responsers), len(c.requests)
+		c.RUnlock()
+		if responsers+requests == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("%d responsers and %d requests left", responsers, requests)
+}
+
+func TestForwardAbort(t *testing.T) {
+	c := dialPeer(t, "test-abort")
+	peer := peerOf(t, c)
+	aborted := make(chan struct{}, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// never responds until the request is aborted
+		<-req.Context().Done()
+		aborted <- struct{}{}
+	}))
+	defer target.Close()
+	proxy := forwardServer(t, target.URL, "test-abort")
+
+	for _, tt := range []struct {
+		name    string
+		timeout string // X-Bifrost-Timeout
+		cancel  time.Duration
+		want    int
+	}{
+		{name: "timeout", timeout: "1", want: http.StatusGatewayTimeout},
+		{name: "canceled", cancel: 200 * time.Millisecond},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.cancel > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.cancel)
+				defer cancel()
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, proxy.URL, nil)
+			if err != nil {
+				t.Fatalf("NewRequest() error = %v", err)
+			}
+			if tt.timeout != "" {
+				req.Header.Set("X-Bifrost-Timeout", tt.timeout)
+			}
+			rsp, err := http.DefaultClient.Do(req)
+			if tt.want != 0 {
+				if err != nil {
+					t.Fatalf("Do() error = %v", err)
+				}
+				rsp.Body.Close()
+				if got := rsp.Header.Get(errorHeader); rsp.StatusCode != tt.want || got != errCodeTimeout.String() {
+					t.Errorf("status = %d %s, want %d %s", rsp.StatusCode, got, tt.want, errCodeTimeout)
+				}
+			} else if err == nil {
+				rsp.Body.Close()
+				t.Fatalf("Do() succeeded, want canceled")
+			}
+			// the peer is told to abort requesting the target
+			select {
+			case <-aborted:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("request to target not aborted")
+			}
+			waitIdle(t, c)
+			waitIdle(t, peer)
+		})
+	}
+}
+
+func TestForwardDisconnect(t *testing.T) {
+	var calls int32
+	started := make(chan struct{}, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// the first request hangs until its connection is killed, which is
+		// only noticed by the server after the body is read
+		io.Copy(ioutil.Discard, req.Body)
+		if atomic.AddInt32(&calls, 1) == 1 {
+			started <- struct{}{}
+			<-req.Context().Done()
+			return
+		}
+		io.WriteString(rw, "ok")
+	}))
+	defer target.Close()
+
+	for _, tt := range []struct {
+		name     string
+		method   string
+		body     string
+		want     int
+		wantCode errCode
+	}{
+		{name: "idempotent retried", method: http.MethodGet, want: http.StatusOK},
+		{name: "in flight failed", method: http.MethodPost, body: "data", want: http.StatusBadGateway, wantCode: errCodeConnClosed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+			name := "test-disconnect-" + tt.method
+			c := dialPeer(t, name)
+			proxy := forwardServer(t, target.URL, name)
+			type result struct {
+				rsp *http.Response
+				err error
+			}
+			done := make(chan result, 1)
+			go func() {
+				req, _ := http.NewRequest(tt.method, proxy.URL, strings.NewReader(tt.body))
+				if tt.body == "" {
+					req.Body = nil
+				}
+				rsp, err := http.DefaultClient.Do(req)
+				done <- result{rsp, err}
+			}()
+			<-started
+			// another connection to the peer, then kill the one in use
+			dialPeer(t, name)
+			c.conn.Close()
+
+			r := <-done
+			if r.err != nil {
+				t.Fatalf("Do() error = %v", r.err)
+			}
+			r.rsp.Body.Close()
+			if got := r.rsp.Header.Get(errorHeader); r.rsp.StatusCode != tt.want || tt.wantCode != errCodeNone && got != tt.wantCode.String() {
+				t.Errorf("status = %d %s, want %d %s", r.rsp.StatusCode, got, tt.want, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestBalance(t *testing.T) {
+	if err := NewDefaultHub().SetBalance("random"); err == nil {
+		t.Errorf("SetBalance(random) succeeded")
+	}
+	dispatchOnce.Do(func() { go Hub.dispatchIngress() })
+	srv := httptest.NewServer(http.HandlerFunc(ServeWS))
+	defer srv.Close()
+	addr := "ws://" + strings.TrimPrefix(srv.URL, "http://") + "/ws"
+
+	for _, tt := range []struct {
+		balance  string
+		poolSize int
+		inflight []int32 // requests waiting on each client of the pool
+		want     []int   // times each client is picked by 6 picks
+	}{
+		{balance: BalanceRoundRobin, poolSize: 0, want: []int{6}},
+		{balance: BalanceRoundRobin, poolSize: 3, want: []int{2, 2, 2}},
+		{balance: BalanceLeastInflight, poolSize: 3, inflight: []int32{2, 0, 1}, want: []int{0, 6, 0}},
+	} {
+		t.Run(fmt.Sprintf("%s/%d", tt.balance, tt.poolSize), func(t *testing.T) {
+			pool := dialPool(addr, tt.poolSize, newDialer(nil))
+			defer func() {
+				for _, c := range pool {
+					c.conn.Close()
+				}
+			}()
+			if len(pool) != len(tt.want) {
+				t.Fatalf("dialPool() = %d clients, want %d", len(pool), len(tt.want))
+			}
+			// a hub of the dialing side only
+			h := NewDefaultHub()
+			if err := h.SetBalance(tt.balance); err != nil {
+				t.Fatalf("SetBalance() error = %v", err)
+			}
+			h.list = pool
+			for i, n := range tt.inflight {
+				pool[i].inflight = n
+			}
+			got := make([]int, len(pool))
+			for i := 0; i < 6; i++ {
+				c, err := h.pick("", "")
+				if err != nil {
+					t.Fatalf("pick() error = %v", err)
+				}
+				for j := range pool {
+					if pool[j] == c {
+						got[j]++
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("picked %v times, want %v", got, tt.want)
+			}
+		})
+	}
+}
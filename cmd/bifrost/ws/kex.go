@@ -0,0 +1,68 @@
+package ws
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Info of HKDF to derive session keys.
+const sessionKeyInfo = "bifrost session keys"
+
+// ID of the session key in its keyring.
+const sessionKeyID uint8 = 0
+
+// ephemeralKey is an X25519 key pair generated for one connection, so that
+// recorded traffic can not be decrypted even if the pre-shared key leaks.
+type ephemeralKey struct {
+	private []byte
+	public  []byte
+}
+
+func newEphemeralKey() (*ephemeralKey, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &ephemeralKey{private: private, public: public}, nil
+}
+
+// deriveSessionKeys derives the keys to send and receive on a connection from
+// the shared secret with peerPublic. The two directions use different keys.
+// The dialing side reports whether the key pair is of the dialing side.
+func (k *ephemeralKey) deriveSessionKeys(peerPublic []byte, dialing bool) (send, recv *Keyring, err error) {
+	shared, err := curve25519.X25519(k.private, peerPublic)
+	if err != nil {
+		return nil, nil, err
+	}
+	dialerPublic, acceptorPublic := k.public, peerPublic
+	if !dialing {
+		dialerPublic, acceptorPublic = peerPublic, k.public
+	}
+	salt := append(append([]byte{}, dialerPublic...), acceptorPublic...)
+	kdf := hkdf.New(sha256.New, shared, salt, []byte(sessionKeyInfo))
+	// dialer to acceptor, then acceptor to dialer
+	keys := make([]byte, 2*keySize)
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		return nil, nil, err
+	}
+	send, recv = NewKeyring(sessionKeyID), NewKeyring(sessionKeyID)
+	sendKey, recvKey := keys[:keySize], keys[keySize:]
+	if !dialing {
+		sendKey, recvKey = recvKey, sendKey
+	}
+	if err := send.Add(sessionKeyID, sendKey); err != nil {
+		return nil, nil, err
+	}
+	if err := recv.Add(sessionKeyID, recvKey); err != nil {
+		return nil, nil, err
+	}
+	return send, recv, nil
+}
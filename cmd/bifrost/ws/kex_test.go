@@ -0,0 +1,52 @@
+package ws
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeriveSessionKeys(t *testing.T) {
+	dialer, err := newEphemeralKey()
+	if err != nil {
+		t.Fatalf("newEphemeralKey() error = %v", err)
+	}
+	acceptor, err := newEphemeralKey()
+	if err != nil {
+		t.Fatalf("newEphemeralKey() error = %v", err)
+	}
+	dialerSend, dialerRecv, err := dialer.deriveSessionKeys(acceptor.public, true)
+	if err != nil {
+		t.Fatalf("deriveSessionKeys() error = %v", err)
+	}
+	acceptorSend, acceptorRecv, err := acceptor.deriveSessionKeys(dialer.public, false)
+	if err != nil {
+		t.Fatalf("deriveSessionKeys() error = %v", err)
+	}
+
+	input := []byte("To be encrypted content.")
+	for _, tt := range []struct {
+		name    string
+		send    *Keyring
+		recv    *Keyring
+		wantErr bool
+	}{
+		{name: "dialer to acceptor", send: dialerSend, recv: acceptorRecv},
+		{name: "acceptor to dialer", send: acceptorSend, recv: dialerRecv},
+		{name: "reflected to dialer", send: dialerSend, recv: dialerRecv, wantErr: true},
+		{name: "pre-shared key", send: testKeyring, recv: acceptorRecv, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ciphertext, err := Encrypt(tt.send, input)
+			if err != nil {
+				t.Fatalf("Encrypt() error = %v", err)
+			}
+			output, err := Decrypt(tt.recv, ciphertext)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decrypt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(output, input) {
+				t.Errorf("Decrypt() = %v, want %v", output, input)
+			}
+		})
+	}
+}
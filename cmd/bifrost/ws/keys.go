@@ -0,0 +1,105 @@
+package ws
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Size of keys, for both AES-256 and ChaCha20.
+const keySize = 32
+
+// keyring used to encrypt the tunnel, see SetKeyring.
+var keyring *Keyring
+
+// Keyring holds the pre-shared keys of the tunnel by key ID. The active key
+// encrypts, and all keys decrypt, so keys can be rotated without downtime:
+// add the new key to all peers, then make it active, then remove the old one.
+type Keyring struct {
+	keys   map[uint8][]byte
+	active uint8
+}
+
+// NewKeyring creates an empty keyring, in which key of ID active encrypts.
+func NewKeyring(active uint8) *Keyring {
+	return &Keyring{
+		keys:   make(map[uint8][]byte),
+		active: active,
+	}
+}
+
+// Add adds the key of id to the keyring.
+func (kr *Keyring) Add(id uint8, key []byte) error {
+	if len(key) != keySize {
+		return fmt.Errorf("key %d: invalid size %d, want %d", id, len(key), keySize)
+	}
+	if _, ok := kr.keys[id]; ok {
+		return fmt.Errorf("key %d: duplicate key ID", id)
+	}
+	kr.keys[id] = key
+	return nil
+}
+
+// activeKey returns the ID and key to encrypt.
+func (kr *Keyring) activeKey() (uint8, []byte, error) {
+	if kr == nil {
+		return 0, nil, errors.New("no key configured")
+	}
+	key, ok := kr.keys[kr.active]
+	if !ok {
+		return 0, nil, fmt.Errorf("active key %d not found", kr.active)
+	}
+	return kr.active, key, nil
+}
+
+// key returns the key of id to decrypt.
+func (kr *Keyring) key(id uint8) ([]byte, error) {
+	if kr == nil {
+		return nil, errors.New("no key configured")
+	}
+	key, ok := kr.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID: %d", id)
+	}
+	return key, nil
+}
+
+// SetKeyring sets the keyring used to encrypt the tunnel.
+func SetKeyring(kr *Keyring) {
+	keyring = kr
+}
+
+// LoadKey loads a hex encoded key from the first non-empty source of: the
+// literal hexKey, the environment variable env, and the file.
+func LoadKey(hexKey, env, file string) ([]byte, error) {
+	switch {
+	case hexKey != "":
+	case env != "":
+		hexKey = os.Getenv(env)
+		if hexKey == "" {
+			return nil, fmt.Errorf("environment variable %s is empty", env)
+		}
+	case file != "":
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		hexKey = string(b)
+	default:
+		return nil, errors.New("no key source")
+	}
+	return hex.DecodeString(strings.TrimSpace(hexKey))
+}
+
+// GenKey generates a random hex encoded key.
+func GenKey() (string, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return strings.ToUpper(hex.EncodeToString(key)), nil
+}
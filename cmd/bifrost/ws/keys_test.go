@@ -0,0 +1,57 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadKey(t *testing.T) {
+	const hexKey = "904F4BD34C303D2A2F5C609D3DEF710FEEBDE497DF4840380927D744D343D4CD"
+	want, _ := hex.DecodeString(hexKey)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(file, []byte(hexKey+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	badFile := filepath.Join(dir, "bad")
+	if err := ioutil.WriteFile(badFile, []byte("not hex"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	os.Setenv("BIFROST_TEST_KEY", hexKey)
+	defer os.Unsetenv("BIFROST_TEST_KEY")
+	os.Unsetenv("BIFROST_TEST_EMPTY")
+
+	tests := []struct {
+		name    string
+		hexKey  string
+		env     string
+		file    string
+		want    []byte
+		wantErr bool
+	}{
+		{name: "literal", hexKey: hexKey, want: want},
+		{name: "literal over env", hexKey: hexKey, env: "BIFROST_TEST_EMPTY", want: want},
+		{name: "env", env: "BIFROST_TEST_KEY", want: want},
+		{name: "env over file", env: "BIFROST_TEST_KEY", file: badFile, want: want},
+		{name: "empty env", env: "BIFROST_TEST_EMPTY", file: file, wantErr: true},
+		{name: "file", file: file, want: want},
+		{name: "file not found", file: filepath.Join(dir, "missing"), wantErr: true},
+		{name: "invalid hex", file: badFile, wantErr: true},
+		{name: "no source", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadKey(tt.hexKey, tt.env, tt.file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("LoadKey() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
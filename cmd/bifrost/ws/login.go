@@ -0,0 +1,290 @@
+package ws
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Wenchy/bifrost/internal/atom"
+	"github.com/Wenchy/bifrost/internal/packet"
+	"github.com/gorilla/websocket"
+)
+
+// Time allowed to finish the login handshake.
+const loginWait = 10 * time.Second
+
+// Code of login reply packet when login is rejected.
+const loginCodeRejected int32 = 1
+
+// identity presented to peers when login, see SetIdentity.
+var (
+	selfName  string
+	authToken string
+)
+
+// random ID of this process presented when login, which tells the pooled
+// connections of a peer from those of another peer presenting the same name.
+var instanceID string
+
+func init() {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	instanceID = hex.EncodeToString(b[:])
+}
+
+// loginInfo is the payload of login packets, which are encrypted by the
+// pre-shared key, so that the ephemeral public keys are authenticated. The
+// reply echoes the public key of the dialing side, so a recorded reply is not
+// taken by another login.
+type loginInfo struct {
+	Name      string   `json:"name"`                 // name of the sender
+	Token     string   `json:"token,omitempty"`      // token presented by the dialing side
+	Instance  string   `json:"instance,omitempty"`   // instance ID of the sender
+	ID        uint64   `json:"id,omitempty"`         // client ID assigned by the accepting side
+	PublicKey []byte   `json:"public_key,omitempty"` // ephemeral X25519 public key of the sender
+	PeerKey   []byte   `json:"peer_key,omitempty"`   // ephemeral public key of the dialing side, echoed by the reply
+	Codecs    []string `json:"codecs,omitempty"`     // codecs offered by the dialing side in order of preference
+	Codec     string   `json:"codec,omitempty"`      // codec chosen by the accepting side
+	Caps      uint32   `json:"caps,omitempty"`       // capability bits of the sender
+	MaxSize   int      `json:"max_size,omitempty"`   // maximum message size allowed by the sender
+	Error     string   `json:"error,omitempty"`      // reason of rejection
+}
+
+// SetIdentity sets the name and token presented to peers when login. If
+// token is not empty, peers must also present the same token.
+func SetIdentity(name, token string) {
+	selfName = name
+	authToken = token
+}
+
+// login sends a login packet right after the websocket is connected, and
+// waits for the accepting side to assign the client ID. The session keys and
+// the codec of the connection are negotiated meanwhile, and confirmed to the
+// accepting side at last.
+func (c *Client) login(conn *websocket.Conn) error {
+	ephemeral, err := newEphemeralKey()
+	if err != nil {
+		return err
+	}
+	if err := writeLogin(conn, 0, &loginInfo{Name: selfName, Token: authToken, Instance: instanceID, PublicKey: ephemeral.public, Codecs: codecPrefs, Caps: uint32(packet.Capabilities), MaxSize: maxMessageSize}); err != nil {
+		return err
+	}
+	pkt, info, err := readLogin(conn)
+	if err != nil {
+		return err
+	}
+	if pkt.Header.Code != 0 {
+		return fmt.Errorf("login rejected by %s: %s", info.Name, info.Error)
+	}
+	if !bytes.Equal(info.PeerKey, ephemeral.public) {
+		return fmt.Errorf("login reply of %s not bound to this login", info.Name)
+	}
+	if err := checkPeerMaxSize(info.MaxSize); err != nil {
+		return fmt.Errorf("login to %s failed: %v", info.Name, err)
+	}
+	sendKeys, recvKeys, err := ephemeral.deriveSessionKeys(info.PublicKey, true)
+	if err != nil {
+		return fmt.Errorf("key exchange with %s failed: %v", info.Name, err)
+	}
+	codec := defaultCodec
+	if info.Codec != "" {
+		codec = negotiateCodec([]string{info.Codec}, codecPrefs)
+		if codec == nil {
+			return fmt.Errorf("unsupported codec chosen by %s: %s", info.Name, info.Codec)
+		}
+	}
+	c.ID = info.ID
+	c.Name = info.Name
+	c.instance = info.Instance
+	c.Capabilities = packet.Capability(info.Caps)
+	c.peerMaxMessageSize = info.MaxSize
+	c.session = newSession(sendKeys, recvKeys, codec)
+	if err := writeConfirm(conn, c.ID, c.session, loginTranscript(ephemeral.public, info.PublicKey)); err != nil {
+		return err
+	}
+	atom.Log.Infof("%v|login to %s succeeded, codec: %s", c.ID, c.Name, codec.Name())
+	return nil
+}
+
+// acceptLogin waits for the login packet of a newly connected client, and
+// assigns a unique ID to it. The codec is the most preferred one which is
+// also offered by the client, or the default codec if nothing is offered.
+// The login succeeds only after the client confirms the session keys, so a
+// recorded login replayed by others is rejected.
+func (c *Client) acceptLogin() error {
+	_, info, err := readLogin(c.conn)
+	if err != nil {
+		return err
+	}
+	if authToken != "" && subtle.ConstantTimeCompare([]byte(info.Token), []byte(authToken)) != 1 {
+		reply := &loginInfo{Name: selfName, Error: "invalid token"}
+		if err := writeLogin(c.conn, loginCodeRejected, reply); err != nil {
+			atom.Log.Warnf("write login reply failed: %v", err)
+		}
+		return fmt.Errorf("invalid token from %s", info.Name)
+	}
+	if err := checkPeerMaxSize(info.MaxSize); err != nil {
+		reply := &loginInfo{Name: selfName, Error: err.Error()}
+		if err := writeLogin(c.conn, loginCodeRejected, reply); err != nil {
+			atom.Log.Warnf("write login reply failed: %v", err)
+		}
+		return fmt.Errorf("login of %s failed: %v", info.Name, err)
+	}
+	if err := Hub.checkName(info.Name, info.Instance); err != nil {
+		reply := &loginInfo{Name: selfName, Error: err.Error()}
+		if err := writeLogin(c.conn, loginCodeRejected, reply); err != nil {
+			atom.Log.Warnf("write login reply failed: %v", err)
+		}
+		return fmt.Errorf("login of %s failed: %v", info.Name, err)
+	}
+	codec := defaultCodec
+	if len(info.Codecs) != 0 {
+		codec = negotiateCodec(codecPrefs, info.Codecs)
+		if codec == nil {
+			reply := &loginInfo{Name: selfName, Error: "no common codec"}
+			if err := writeLogin(c.conn, loginCodeRejected, reply); err != nil {
+				atom.Log.Warnf("write login reply failed: %v", err)
+			}
+			return fmt.Errorf("no common codec with %s: %v", info.Name, info.Codecs)
+		}
+	}
+	ephemeral, err := newEphemeralKey()
+	if err != nil {
+		return err
+	}
+	sendKeys, recvKeys, err := ephemeral.deriveSessionKeys(info.PublicKey, false)
+	if err != nil {
+		reply := &loginInfo{Name: selfName, Error: "key exchange failed"}
+		if err := writeLogin(c.conn, loginCodeRejected, reply); err != nil {
+			atom.Log.Warnf("write login reply failed: %v", err)
+		}
+		return fmt.Errorf("key exchange with %s failed: %v", info.Name, err)
+	}
+	c.ID = genClientID()
+	c.Name = info.Name
+	c.instance = info.Instance
+	c.Capabilities = packet.Capability(info.Caps)
+	c.peerMaxMessageSize = info.MaxSize
+	c.session = newSession(sendKeys, recvKeys, codec)
+	if err := writeLogin(c.conn, 0, &loginInfo{Name: selfName, ID: c.ID, Instance: instanceID, PublicKey: ephemeral.public, PeerKey: info.PublicKey, Codec: codec.Name(), Caps: uint32(packet.Capabilities), MaxSize: maxMessageSize}); err != nil {
+		return err
+	}
+	if err := readConfirm(c.conn, c.ID, c.session, loginTranscript(info.PublicKey, ephemeral.public)); err != nil {
+		return fmt.Errorf("key confirmation of %s failed: %v", info.Name, err)
+	}
+	atom.Log.Infof("%v|%s login succeeded, codec: %s", c.ID, c.Name, codec.Name())
+	return nil
+}
+
+// checkPeerMaxSize checks the max message size advertised by the peer when
+// login, which must hold a header and a fair payload. 0 means not advertised.
+func checkPeerMaxSize(size int) error {
+	if size != 0 && size < minMessageSize {
+		return fmt.Errorf("max message size %d less than %d", size, minMessageSize)
+	}
+	return nil
+}
+
+func writeLogin(conn *websocket.Conn, code int32, info *loginInfo) error {
+	raw, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	pkt := packet.NewSeqPacket(packet.PacketTypeLogin, 0, nil)
+	if err := seal(keyring, defaultCodec, pkt, raw); err != nil {
+		return err
+	}
+	pkt.Header.ID = info.ID
+	pkt.Header.Code = code
+	return writeLoginPacket(conn, pkt)
+}
+
+func readLogin(conn *websocket.Conn) (*packet.Packet, *loginInfo, error) {
+	pkt, err := readLoginPacket(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := unseal(keyring, pkt)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := &loginInfo{}
+	if err := json.Unmarshal(raw, info); err != nil {
+		return nil, nil, err
+	}
+	return pkt, info, nil
+}
+
+// loginTranscript returns the ephemeral public keys of both sides, which are
+// confirmed by the dialing side with the session keys.
+func loginTranscript(dialerPublic, acceptorPublic []byte) []byte {
+	return append(append([]byte{}, dialerPublic...), acceptorPublic...)
+}
+
+// writeConfirm sends the login transcript sealed by the session keys, which
+// is the first packet of session, so that the accepting side knows the
+// dialing side holds the ephemeral key it logged in with.
+func writeConfirm(conn *websocket.Conn, id uint64, s *session, transcript []byte) error {
+	f, err := s.frame(packet.NewSeqPacket(packet.PacketTypeLogin, 0, nil), transcript, false)
+	if err != nil {
+		return err
+	}
+	if err := s.seal(f); err != nil {
+		return err
+	}
+	f.pkt.Header.ID = id
+	return writeLoginPacket(conn, f.pkt)
+}
+
+// readConfirm waits for the login transcript sealed by the session keys of
+// the client of id.
+func readConfirm(conn *websocket.Conn, id uint64, s *session, transcript []byte) error {
+	pkt, err := readLoginPacket(conn)
+	if err != nil {
+		return err
+	}
+	if pkt.Header.ID != id {
+		return fmt.Errorf("confirmation of ID %v, want %v", pkt.Header.ID, id)
+	}
+	raw, err := s.unseal(pkt)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(raw, transcript) != 1 {
+		return errors.New("login transcript mismatch")
+	}
+	return nil
+}
+
+func writeLoginPacket(conn *websocket.Conn, pkt *packet.Packet) error {
+	buf, err := packet.Encode(pkt)
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(loginWait))
+	return conn.WriteMessage(websocket.BinaryMessage, buf)
+}
+
+func readLoginPacket(conn *websocket.Conn) (*packet.Packet, error) {
+	conn.SetReadLimit(int64(maxMessageSize))
+	conn.SetReadDeadline(time.Now().Add(loginWait))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	pkt, err := packet.Parse(msg)
+	if err != nil {
+		return nil, err
+	}
+	if pkt.Header.Type != packet.PacketTypeLogin {
+		return nil, fmt.Errorf("unexpected packet type: %v, want login", pkt.Header.Type)
+	}
+	return pkt, nil
+}
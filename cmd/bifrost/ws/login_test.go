@@ -0,0 +1,152 @@
+package ws
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Wenchy/bifrost/internal/packet"
+	"github.com/gorilla/websocket"
+)
+
+func TestLogin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(ServeWS))
+	defer srv.Close()
+	defer SetIdentity("", "")
+	addr := "ws://" + strings.TrimPrefix(srv.URL, "http://") + "/ws"
+
+	// both sides share the identity in this process
+	SetIdentity("dc-east", "secret")
+	c1, err := Dial(addr, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c1.conn.Close()
+	c2, err := Dial(addr, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c2.conn.Close()
+	if c1.ID == 0 || c1.ID == c2.ID {
+		t.Errorf("IDs not unique: %v, %v", c1.ID, c2.ID)
+	}
+	if c1.Name != "dc-east" {
+		t.Errorf("Name = %s, want dc-east", c1.Name)
+	}
+
+	// dial with an incompatible protocol version
+	_, rsp, err := websocket.DefaultDialer.Dial(addr, http.Header{versionHeader: {"1"}})
+	if err == nil || rsp == nil || rsp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("dial with version 1 error = %v, want %d", err, http.StatusUpgradeRequired)
+	}
+
+	// login with a wrong token
+	header := http.Header{versionHeader: {strconv.Itoa(int(packet.Version))}}
+	conn, _, err := websocket.DefaultDialer.Dial(addr, header)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	defer conn.Close()
+	if err := writeLogin(conn, 0, &loginInfo{Name: "dc-west", Token: "wrong"}); err != nil {
+		t.Fatalf("writeLogin() error = %v", err)
+	}
+	pkt, info, err := readLogin(conn)
+	if err != nil {
+		t.Fatalf("readLogin() error = %v", err)
+	}
+	if pkt.Header.Code != loginCodeRejected || info.Error == "" {
+		t.Errorf("login reply code = %v, error = %q, want rejected", pkt.Header.Code, info.Error)
+	}
+
+	// login with a max message size too small to hold a packet
+	conn2, _, err := websocket.DefaultDialer.Dial(addr, header)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	defer conn2.Close()
+	if err := writeLogin(conn2, 0, &loginInfo{Name: "dc-west", Token: "secret", MaxSize: packet.HeaderSize}); err != nil {
+		t.Fatalf("writeLogin() error = %v", err)
+	}
+	pkt, info, err = readLogin(conn2)
+	if err != nil {
+		t.Fatalf("readLogin() error = %v", err)
+	}
+	if pkt.Header.Code != loginCodeRejected || info.Error == "" {
+		t.Errorf("login reply code = %v, error = %q, want rejected", pkt.Header.Code, info.Error)
+	}
+
+	// login with the name of a connected peer from another instance
+	Hub.register(c1)
+	defer Hub.unregister(c1)
+	conn3, _, err := websocket.DefaultDialer.Dial(addr, header)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	defer conn3.Close()
+	if err := writeLogin(conn3, 0, &loginInfo{Name: "dc-east", Token: "secret", Instance: "spoofer"}); err != nil {
+		t.Fatalf("writeLogin() error = %v", err)
+	}
+	pkt, info, err = readLogin(conn3)
+	if err != nil {
+		t.Fatalf("readLogin() error = %v", err)
+	}
+	if pkt.Header.Code != loginCodeRejected || info.Error == "" {
+		t.Errorf("login reply code = %v, error = %q, want rejected", pkt.Header.Code, info.Error)
+	}
+
+	// replay a recorded login, whose key confirmation can only be sealed by
+	// the session keys of the recorded connection
+	ephemeral, err := newEphemeralKey()
+	if err != nil {
+		t.Fatalf("newEphemeralKey() error = %v", err)
+	}
+	login := &loginInfo{Name: "dc-west", Token: "secret", PublicKey: ephemeral.public}
+	conn4, _, err := websocket.DefaultDialer.Dial(addr, header)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	defer conn4.Close()
+	if err := writeLogin(conn4, 0, login); err != nil {
+		t.Fatalf("writeLogin() error = %v", err)
+	}
+	_, recorded, err := readLogin(conn4)
+	if err != nil {
+		t.Fatalf("readLogin() error = %v", err)
+	}
+	if !bytes.Equal(recorded.PeerKey, ephemeral.public) {
+		t.Errorf("login reply not bound to the public key of login")
+	}
+	sendKeys, recvKeys, err := ephemeral.deriveSessionKeys(recorded.PublicKey, true)
+	if err != nil {
+		t.Fatalf("deriveSessionKeys() error = %v", err)
+	}
+	recordedSession := newSession(sendKeys, recvKeys, defaultCodec)
+	conn5, _, err := websocket.DefaultDialer.Dial(addr, header)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	defer conn5.Close()
+	if err := writeLogin(conn5, 0, login); err != nil {
+		t.Fatalf("writeLogin() error = %v", err)
+	}
+	_, info, err = readLogin(conn5)
+	if err != nil {
+		t.Fatalf("readLogin() error = %v", err)
+	}
+	if err := writeConfirm(conn5, info.ID, recordedSession, loginTranscript(ephemeral.public, recorded.PublicKey)); err != nil {
+		t.Fatalf("writeConfirm() error = %v", err)
+	}
+	if _, _, err := conn5.ReadMessage(); err == nil {
+		t.Errorf("replayed login not rejected")
+	}
+	Hub.RLock()
+	for _, c := range Hub.list {
+		if c.ID == info.ID {
+			t.Errorf("replayed login registered as %v", c.ID)
+		}
+	}
+	Hub.RUnlock()
+}
@@ -0,0 +1,24 @@
+package ws
+
+import (
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/Wenchy/bifrost/internal/atom"
+	"go.uber.org/zap"
+)
+
+// testKeyring is the keyring used by tests.
+var testKeyring *Keyring
+
+func TestMain(m *testing.M) {
+	atom.Log = zap.NewNop().Sugar()
+	testKeyring = NewKeyring(1)
+	key, _ := hex.DecodeString("904F4BD34C303D2A2F5C609D3DEF710FEEBDE497DF4840380927D744D343D4CD")
+	if err := testKeyring.Add(1, key); err != nil {
+		panic(err)
+	}
+	SetKeyring(testKeyring)
+	os.Exit(m.Run())
+}
@@ -0,0 +1,540 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Wenchy/bifrost/internal/atom"
+	"github.com/Wenchy/bifrost/internal/packet"
+)
+
+// Streams are bidirectional byte streams multiplexed over a connection, by
+// frames of open, data, half-close and reset with the same stream ID in seq.
+// The data of streams is flow controlled by credits like body chunks, and the
+// frames of streams are written in turn.
+
+// errStreamUnsupported is returned when opening a stream to a peer which does
+// not support streams.
+var errStreamUnsupported = errors.New("stream not supported by peer")
+
+// StreamHandler handles a stream opened by the peer to target. It is called
+// in a new goroutine, and must call s.Accept before writing to s. If an error
+// is returned before accepted, the stream is reset with the error.
+type StreamHandler func(s *Stream, target string) error
+
+var (
+	streamMu       sync.RWMutex
+	streamHandlers = map[string]StreamHandler{}
+)
+
+// RegisterStream registers the handler of streams of kind opened by peers,
+// replacing the previous one if any.
+func RegisterStream(kind string, handler StreamHandler) {
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	streamHandlers[kind] = handler
+}
+
+// streamOpen is the payload of open frames sent by the opening side.
+type streamOpen struct {
+	Kind   string `json:"kind"`
+	Target string `json:"target,omitempty"`
+}
+
+// Stream is a multiplexed stream of a connection, which implements net.Conn.
+type Stream struct {
+	c      *Client
+	id     uint32
+	kind   string
+	target string
+
+	body   *bodyReader // data frames from the peer
+	rmu    sync.Mutex  // serializes reads
+	wmu    sync.Mutex  // serializes writes, so that data frames are in order
+	rd, wd *deadline
+
+	accepted   chan struct{} // closed when the stream is accepted by the peer
+	acceptOnce sync.Once
+
+	mu          sync.Mutex
+	writeClosed bool  // half-closed by CloseWrite
+	closed      bool  // closed by Close
+	err         error // set when reset or the connection is closed
+}
+
+// newStream registers the stream of id, and opens its credit to send data.
+// An ID is allocated if id is 0.
+func (c *Client) newStream(id uint32, kind, target string) *Stream {
+	s := &Stream{
+		c:        c,
+		kind:     kind,
+		target:   target,
+		rd:       newDeadline(),
+		wd:       newDeadline(),
+		accepted: make(chan struct{}),
+	}
+	c.Lock()
+	for id == 0 || c.streams[id] != nil {
+		// skip IDs still used after wraparound
+		id = atomic.AddUint32(&c.streamID, 2)
+	}
+	s.id = id
+	s.body = newBodyReader(newPacketPipe(c.pipeLimit()), c, packet.PacketTypeStreamData, id, s.rd.wait)
+	c.streams[id] = s
+	c.Unlock()
+	c.openStreamCredit(streamKey{typ: packet.PacketTypeStreamData, seq: id})
+	return s
+}
+
+func (c *Client) getStream(id uint32) *Stream {
+	c.RLock()
+	defer c.RUnlock()
+	return c.streams[id]
+}
+
+func (c *Client) removeStream(id uint32) {
+	c.Lock()
+	delete(c.streams, id)
+	c.Unlock()
+	c.closeStreamCredit(streamKey{typ: packet.PacketTypeStreamData, seq: id})
+}
+
+// isLocalStream reports whether the stream of id is opened by this side.
+func (c *Client) isLocalStream(id uint32) bool {
+	return id&1 == atomic.LoadUint32(&c.streamID)&1
+}
+
+// OpenStream opens a stream of kind to target through the peer, and waits
+// until the peer accepts it or ctx is done.
+func (c *Client) OpenStream(ctx context.Context, kind, target string) (*Stream, error) {
+	if !c.hasCap(packet.CapStream) {
+		return nil, errStreamUnsupported
+	}
+	raw, err := json.Marshal(&streamOpen{Kind: kind, Target: target})
+	if err != nil {
+		return nil, err
+	}
+	s := c.newStream(0, kind, target)
+	f, err := c.session.frame(packet.NewSeqPacket(packet.PacketTypeStreamOpen, s.id, nil), raw, true)
+	if err != nil {
+		c.removeStream(s.id)
+		return nil, err
+	}
+	if err := c.sendStreamPacket(f); err != nil {
+		c.removeStream(s.id)
+		return nil, err
+	}
+	select {
+	case <-s.accepted:
+		return s, nil
+	case <-s.body.pipe.aborted:
+		c.removeStream(s.id)
+		return nil, s.body.pipe.abortErr
+	case <-ctx.Done():
+		s.reset(errCodeNone, ctx.Err().Error())
+		return nil, ctx.Err()
+	}
+}
+
+// sendStreamPacket queues f of a stream to be written in turn with other
+// streams.
+func (c *Client) sendStreamPacket(f *frame) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return errConnClosed
+	}
+	c.sched.push(f.pkt.Header.Seq, f)
+	return nil
+}
+
+// sendStreamFrame sends a frame of typ without payload for the stream of id.
+func (c *Client) sendStreamFrame(typ packet.PacketType, id uint32) error {
+	f, err := c.session.frame(packet.NewSeqPacket(typ, id, nil), nil, false)
+	if err != nil {
+		return err
+	}
+	return c.sendStreamPacket(f)
+}
+
+// handleStreamPacket routes a frame to its stream, or opens a stream by the
+// handler registered for its kind.
+func (c *Client) handleStreamPacket(pkt *packet.Packet) {
+	id := pkt.Header.Seq
+	s := c.getStream(id)
+	switch pkt.Header.Type {
+	case packet.PacketTypeStreamOpen:
+		if c.isLocalStream(id) {
+			if s != nil {
+				s.acceptOnce.Do(func() { close(s.accepted) })
+			}
+			return
+		}
+		if s != nil {
+			atom.Log.Warnf("%v|%d|stream already opened", c.ID, id)
+			return
+		}
+		c.acceptStream(pkt)
+	case packet.PacketTypeStreamData, packet.PacketTypeStreamClose:
+		if s == nil || !s.body.pipe.push(pkt) {
+			c.grantDropped(pkt)
+			if pkt.Header.Type == packet.PacketTypeStreamData {
+				// tell the peer not to write any more
+				atom.Log.Debugf("%v|%d|data of stream closed or unknown", c.ID, id)
+				c.resetStream(id, errCodeConnClosed, "stream closed")
+			}
+		}
+	case packet.PacketTypeStreamReset:
+		if s == nil {
+			return
+		}
+		msg, err := c.session.unseal(pkt)
+		if err != nil {
+			msg = []byte(err.Error())
+		}
+		s.abort(&tunnelError{code: errCode(pkt.Header.Code), msg: string(msg)})
+	}
+}
+
+// acceptStream opens the stream requested by the peer, and calls the handler
+// of its kind.
+func (c *Client) acceptStream(pkt *packet.Packet) {
+	id := pkt.Header.Seq
+	raw, err := c.session.unseal(pkt)
+	if err != nil {
+		c.resetStream(id, errCodeDecode, err.Error())
+		return
+	}
+	open := &streamOpen{}
+	if err := json.Unmarshal(raw, open); err != nil {
+		c.resetStream(id, errCodeDecode, err.Error())
+		return
+	}
+	streamMu.RLock()
+	handler := streamHandlers[open.Kind]
+	streamMu.RUnlock()
+	if handler == nil {
+		atom.Log.Warnf("%v|%d|stream of unknown kind: %s", c.ID, id, open.Kind)
+		c.resetStream(id, errCodeRouteDenied, "unknown stream kind: "+open.Kind)
+		return
+	}
+	s := c.newStream(id, open.Kind, open.Target)
+	atom.Log.Debugf("%v|%d|stream opened by peer: %s, %s", c.ID, id, open.Kind, open.Target)
+	go func() {
+		if err := handler(s, open.Target); err != nil {
+			atom.Log.Warnf("%v|%d|handle stream %s to %s failed: %v", c.ID, id, open.Kind, open.Target, err)
+			select {
+			case <-s.accepted:
+				s.Close()
+			default:
+				s.reset(errorCode(err), err.Error())
+			}
+		}
+	}()
+}
+
+// resetStream sends a reset frame of code with msg for the stream of id.
+func (c *Client) resetStream(id uint32, code errCode, msg string) {
+	pkt := packet.NewSeqPacket(packet.PacketTypeStreamReset, id, nil)
+	pkt.Header.Code = int32(code)
+	f, err := c.session.frame(pkt, []byte(msg), false)
+	if err != nil {
+		atom.Log.Warnf("%v|%d|seal stream reset failed: %v", c.ID, id, err)
+		return
+	}
+	if err := c.sendStreamPacket(f); err != nil {
+		atom.Log.Debugf("%v|%d|send stream reset failed: %v", c.ID, id, err)
+	}
+}
+
+// ID returns the ID of stream, unique in its connection.
+func (s *Stream) ID() uint32 { return s.id }
+
+// Kind returns the kind of stream.
+func (s *Stream) Kind() string { return s.kind }
+
+// Target returns the target of stream.
+func (s *Stream) Target() string { return s.target }
+
+// Accept tells the peer that the stream opened by it is accepted.
+func (s *Stream) Accept() error {
+	var err error
+	s.acceptOnce.Do(func() {
+		close(s.accepted)
+		err = s.c.sendStreamFrame(packet.PacketTypeStreamOpen, s.id)
+	})
+	return err
+}
+
+// fail makes all reads and writes of stream fail with err.
+func (s *Stream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.body.pipe.abort(err)
+}
+
+// abort fails the stream with err and removes it, e.g.: reset by the peer.
+func (s *Stream) abort(err error) {
+	s.fail(err)
+	s.c.removeStream(s.id)
+}
+
+// reset aborts the stream, and tells the peer.
+func (s *Stream) reset(code errCode, msg string) {
+	s.abort(&tunnelError{code: code, msg: msg})
+	s.c.resetStream(s.id, code, msg)
+}
+
+// writeErr returns the error of writing to stream, nil if writable.
+func (s *Stream) writeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.closed:
+		return net.ErrClosed
+	case s.err != nil:
+		return s.err
+	case s.writeClosed:
+		return io.ErrClosedPipe
+	}
+	return nil
+}
+
+// Read reads data from the peer, and returns io.EOF once the peer closes
+// writing. The stream is reset if data can not be unsealed, e.g.: replayed.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	n, err := s.body.Read(p)
+	switch err {
+	case nil, io.EOF:
+	case errPipeDone:
+		err = os.ErrDeadlineExceeded
+	case errPipeClosed:
+		err = net.ErrClosed
+	default:
+		// not failed by a reset or the connection closed yet
+		s.mu.Lock()
+		failed := s.err != nil
+		s.mu.Unlock()
+		if !failed {
+			atom.Log.Warnf("%v|%d|read stream failed: %v", s.c.ID, s.id, err)
+			s.reset(errCodeDecode, err.Error())
+		}
+	}
+	return n, err
+}
+
+// Write writes p to the peer as data frames, each waits for the credit
+// granted by the peer. Data is sent as is without compression, as it is
+// often encrypted end to end.
+func (s *Stream) Write(p []byte) (int, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	n := 0
+	for len(p) > 0 {
+		if err := s.writeErr(); err != nil {
+			return n, err
+		}
+		size := len(p)
+		if size > chunkSize {
+			size = chunkSize
+		}
+		f, err := s.c.session.frame(packet.NewSeqPacket(packet.PacketTypeStreamData, s.id, nil), p[:size], false)
+		if err != nil {
+			return n, err
+		}
+		if err := s.c.takeCredit(f, s.wd.wait()); err != nil {
+			if err == errPipeDone {
+				return n, os.ErrDeadlineExceeded
+			}
+			if werr := s.writeErr(); werr != nil {
+				return n, werr
+			}
+			return n, err
+		}
+		if err := s.c.sendStreamPacket(f); err != nil {
+			return n, err
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// CloseWrite half-closes the stream, after which the peer reads io.EOF while
+// the stream can still be read.
+func (s *Stream) CloseWrite() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := s.writeErr(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.writeClosed = true
+	s.mu.Unlock()
+	return s.c.sendStreamFrame(packet.PacketTypeStreamClose, s.id)
+}
+
+// Close closes writing like CloseWrite, and drops the data not read yet.
+// Pending reads and writes are unblocked with net.ErrClosed.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.closed = true
+	sendClose := !s.writeClosed && s.err == nil
+	s.mu.Unlock()
+
+	// wake up pending writes waiting for credit, then pending reads
+	s.c.removeStream(s.id)
+	s.body.Close()
+	if sendClose {
+		s.wmu.Lock()
+		defer s.wmu.Unlock()
+		return s.c.sendStreamFrame(packet.PacketTypeStreamClose, s.id)
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of the connection of stream.
+func (s *Stream) LocalAddr() net.Addr { return s.c.conn.LocalAddr() }
+
+// RemoteAddr returns the remote address of the connection of stream.
+func (s *Stream) RemoteAddr() net.Addr { return s.c.conn.RemoteAddr() }
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.rd.set(t)
+	s.wd.set(t)
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.rd.set(t)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.wd.set(t)
+	return nil
+}
+
+// deadline provides a channel closed when the time set passes.
+type deadline struct {
+	mu    sync.Mutex
+	ch    chan struct{}
+	timer *time.Timer
+	gen   int // generation of the time set, to ignore stale timers
+}
+
+func newDeadline() *deadline {
+	return &deadline{ch: make(chan struct{})}
+}
+
+// set sets the deadline to t, zero means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gen++
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	select {
+	case <-d.ch:
+		// renew the channel expired
+		d.ch = make(chan struct{})
+	default:
+	}
+	if t.IsZero() {
+		return
+	}
+	dur := time.Until(t)
+	if dur <= 0 {
+		close(d.ch)
+		return
+	}
+	gen := d.gen
+	d.timer = time.AfterFunc(dur, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.gen == gen {
+			close(d.ch)
+		}
+	})
+}
+
+// wait returns the channel closed when the deadline passes.
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ch
+}
+
+// scheduler queues the frames of streams, which are written in turn so that
+// a busy stream does not starve others.
+type scheduler struct {
+	mu     sync.Mutex
+	queues map[uint32][]*frame
+	order  []uint32      // IDs of streams with frames queued, in turn
+	ready  chan struct{} // signaled when frames are queued
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		queues: map[uint32][]*frame{},
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// push queues frames of the stream of id.
+func (s *scheduler) push(id uint32, frames ...*frame) {
+	s.mu.Lock()
+	if len(s.queues[id]) == 0 {
+		s.order = append(s.order, id)
+	}
+	s.queues[id] = append(s.queues[id], frames...)
+	s.mu.Unlock()
+	s.signal()
+}
+
+// pop dequeues a frame of the stream in turn, nil if none.
+func (s *scheduler) pop() *frame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.order) == 0 {
+		return nil
+	}
+	id := s.order[0]
+	s.order = s.order[1:]
+	q := s.queues[id]
+	f := q[0]
+	if len(q) == 1 {
+		delete(s.queues, id)
+	} else {
+		q[0] = nil
+		s.queues[id] = q[1:]
+		s.order = append(s.order, id)
+	}
+	if len(s.order) != 0 {
+		s.signal()
+	}
+	return f
+}
+
+func (s *scheduler) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
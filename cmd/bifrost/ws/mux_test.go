@@ -0,0 +1,150 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Wenchy/bifrost/internal/packet"
+)
+
+func TestStream(t *testing.T) {
+	RegisterStream("test-echo", func(s *Stream, target string) error {
+		if target != "echo:7" {
+			return errors.New("unexpected target: " + target)
+		}
+		if err := s.Accept(); err != nil {
+			return err
+		}
+		defer s.Close()
+		if _, err := io.Copy(s, s); err != nil {
+			return err
+		}
+		return s.CloseWrite()
+	})
+	c := dialPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// more than the stream window, so the writer waits for credit
+	data := bytes.Repeat([]byte("bifrost"), 200*1024)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		s, err := c.OpenStream(ctx, "test-echo", "echo:7")
+		if err != nil {
+			t.Fatalf("OpenStream() error = %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.Close()
+			go func() {
+				s.Write(data)
+				s.CloseWrite()
+			}()
+			got, err := ioutil.ReadAll(s)
+			if err != nil {
+				t.Errorf("ReadAll() error = %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("echoed %d bytes, want %d", len(got), len(data))
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, err := c.OpenStream(ctx, "test-unknown", "")
+	var te *tunnelError
+	if !errors.As(err, &te) || te.code != errCodeRouteDenied {
+		t.Errorf("OpenStream() of unknown kind error = %v, want %v", err, errCodeRouteDenied)
+	}
+	_, err = c.OpenStream(ctx, "test-echo", "echo:8")
+	if !errors.As(err, &te) {
+		t.Errorf("OpenStream() rejected by handler error = %v, want tunnel error", err)
+	}
+
+	s, err := c.OpenStream(ctx, "test-echo", "echo:7")
+	if err != nil {
+		t.Fatalf("OpenStream() error = %v", err)
+	}
+	s.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := s.Read(make([]byte, 1)); err != os.ErrDeadlineExceeded {
+		t.Errorf("Read() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	s.SetReadDeadline(time.Time{})
+	if _, err := s.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Read() = %q, %v, want ping", buf, err)
+	}
+	s.Close()
+	if _, err := s.Write([]byte("ping")); err == nil {
+		t.Errorf("Write() after Close succeeded")
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	data := func(payload string) *frame {
+		return &frame{pkt: packet.NewSeqPacket(packet.PacketTypeStreamData, 0, []byte(payload))}
+	}
+	s := newScheduler()
+	s.push(1, data("1a"), data("1b"), data("1c"))
+	s.push(2, data("2a"))
+	s.push(3, data("3a"), data("3b"))
+	var got []string
+	for f := s.pop(); f != nil; f = s.pop() {
+		got = append(got, string(f.pkt.Payload))
+	}
+	want := "1a 2a 3a 1b 3b 1c"
+	if strings.Join(got, " ") != want {
+		t.Errorf("pop() order = %v, want %v", got, want)
+	}
+}
+
+func TestStreamSmallWrites(t *testing.T) {
+	RegisterStream("test-echo-small", func(s *Stream, target string) error {
+		if err := s.Accept(); err != nil {
+			return err
+		}
+		defer s.Close()
+		if _, err := io.Copy(s, s); err != nil {
+			return err
+		}
+		return s.CloseWrite()
+	})
+	c := dialPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := c.OpenStream(ctx, "test-echo-small", "")
+	if err != nil {
+		t.Fatalf("OpenStream() error = %v", err)
+	}
+	defer s.Close()
+
+	// frames queued behind many window updates are still in counter order
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	go func() {
+		for i := range data {
+			if _, err := s.Write(data[i : i+1]); err != nil {
+				return
+			}
+		}
+		s.CloseWrite()
+	}()
+	got, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("echoed %d bytes, want %d", len(got), len(data))
+	}
+}
@@ -0,0 +1,325 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Wenchy/bifrost/internal/atom"
+	"github.com/Wenchy/bifrost/internal/packet"
+)
+
+// Kinds of built-in notices, more kinds can be added by RegisterNotice.
+const (
+	NoticePing      = "ping"      // latency probe, answered by pong
+	NoticePong      = "pong"      // answer of ping
+	NoticeDraining  = "draining"  // the sender is shutting down, and takes no more requests
+	NoticeAdvertise = "advertise" // capabilities and config of the sender
+	NoticeRoutes    = "routes"    // hosts reachable through the sender
+)
+
+// Interval to probe the latency of connections by ping notices.
+const pingNoticePeriod = 10 * time.Second
+
+// errNoticeUnsupported is returned when sending a notice to a peer which does
+// not support notices.
+var errNoticeUnsupported = errors.New("notice not supported by peer")
+
+// notice is the payload of notice packets, a typed control message between
+// peers.
+type notice struct {
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// NoticeHandler handles the data of a notice received from the peer of c. It
+// is called in the goroutine dispatching packets, so it must not block.
+type NoticeHandler func(c *Client, data json.RawMessage) error
+
+var (
+	noticeMu       sync.RWMutex
+	noticeHandlers = map[string]NoticeHandler{}
+)
+
+// RegisterNotice registers the handler of notices of kind, replacing the
+// previous one if any.
+func RegisterNotice(kind string, handler NoticeHandler) {
+	noticeMu.Lock()
+	defer noticeMu.Unlock()
+	noticeHandlers[kind] = handler
+}
+
+func init() {
+	RegisterNotice(NoticePing, handlePing)
+	RegisterNotice(NoticePong, handlePong)
+	RegisterNotice(NoticeDraining, handleDraining)
+	RegisterNotice(NoticeAdvertise, handleAdvertise)
+	RegisterNotice(NoticeRoutes, handleRoutes)
+}
+
+// SendNotice sends a notice of kind with data v encoded as JSON to the peer.
+func (c *Client) SendNotice(kind string, v interface{}) error {
+	f, err := c.noticeFrame(kind, v)
+	if err != nil {
+		return err
+	}
+	return c.send(f)
+}
+
+func (c *Client) noticeFrame(kind string, v interface{}) (*frame, error) {
+	if !c.hasCap(packet.CapNotice) {
+		return nil, errNoticeUnsupported
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(&notice{Kind: kind, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	pkt := packet.NewSeqPacket(packet.PacketTypeNotice, 0, nil)
+	return c.session.frame(pkt, raw, true)
+}
+
+// handleNotice calls the handler registered for the kind of notice. Notices
+// of unknown kinds are ignored, as they may be sent by newer peers.
+func (h *hub) handleNotice(c *Client, pkt *packet.Packet) {
+	raw, err := c.session.unseal(pkt)
+	if err != nil {
+		atom.Log.Warnf("%v|unseal notice failed: %v", c.ID, err)
+		return
+	}
+	n := &notice{}
+	if err := json.Unmarshal(raw, n); err != nil {
+		atom.Log.Warnf("%v|decode notice failed: %v", c.ID, err)
+		return
+	}
+	noticeMu.RLock()
+	handler := noticeHandlers[n.Kind]
+	noticeMu.RUnlock()
+	if handler == nil {
+		atom.Log.Debugf("%v|notice of unknown kind ignored: %s", c.ID, n.Kind)
+		return
+	}
+	if err := handler(c, n.Data); err != nil {
+		atom.Log.Warnf("%v|handle notice %s failed: %v", c.ID, n.Kind, err)
+	}
+}
+
+type pingNotice struct {
+	Sent int64 `json:"sent"` // unix nano time of the sender when sent
+}
+
+func handlePing(c *Client, data json.RawMessage) error {
+	// echo back as is without waiting for the send queue, as handlers must
+	// not block; a pong dropped only misses a latency sample
+	f, err := c.noticeFrame(NoticePong, data)
+	if err != nil {
+		return err
+	}
+	return c.trySend(f)
+}
+
+func handlePong(c *Client, data json.RawMessage) error {
+	ping := &pingNotice{}
+	if err := json.Unmarshal(data, ping); err != nil {
+		return err
+	}
+	latency := time.Now().UnixNano() - ping.Sent
+	atomic.StoreInt64(&c.latency, latency)
+	atom.Log.Debugf("%v|latency to %s: %v", c.ID, c.Name, time.Duration(latency))
+	return nil
+}
+
+func handleDraining(c *Client, data json.RawMessage) error {
+	atomic.StoreInt32(&c.draining, 1)
+	atom.Log.Infof("%v|peer %s is draining, no more requests will be sent", c.ID, c.Name)
+	return nil
+}
+
+type advertiseNotice struct {
+	Version uint8    `json:"version"`
+	Caps    uint32   `json:"caps"`
+	Codecs  []string `json:"codecs,omitempty"`
+	Timeout int      `json:"timeout,omitempty"` // default request timeout in seconds
+}
+
+func handleAdvertise(c *Client, data json.RawMessage) error {
+	adv := &advertiseNotice{}
+	if err := json.Unmarshal(data, adv); err != nil {
+		return err
+	}
+	// capabilities are fixed once negotiated at login, as both sides have
+	// already started to talk by them
+	if packet.Capability(adv.Caps) != c.Capabilities {
+		atom.Log.Warnf("%v|peer %s advertised caps %#x differ from %#x at login, ignored", c.ID, c.Name, adv.Caps, c.Capabilities)
+	}
+	atom.Log.Infof("%v|peer %s advertised version: %d, caps: %#x, codecs: %v, timeout: %ds", c.ID, c.Name, adv.Version, adv.Caps, adv.Codecs, adv.Timeout)
+	return nil
+}
+
+// hosts reachable through this node announced to peers, see SetRoutes, and
+// hosts which peers may announce, see SetAcceptRoutes.
+var (
+	routes       []string
+	acceptRoutes map[string]bool
+)
+
+// SetRoutes sets the hosts reachable through this node, e.g.: "10.0.0.1:8080"
+// or "api.internal", which are announced to peers. Peers prefer the
+// connections announcing the host of target when picking.
+func SetRoutes(hosts []string) {
+	routes = hosts
+}
+
+// SetAcceptRoutes sets the hosts which peers may announce as routes, either
+// with or without port. Other hosts announced are dropped, and none is
+// accepted by default, so that a peer can not draw requests to any host.
+func SetAcceptRoutes(hosts []string) {
+	accepted := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		accepted[host] = true
+	}
+	acceptRoutes = accepted
+}
+
+// acceptRoute reports whether a peer may announce host as a route.
+func acceptRoute(host string) bool {
+	if acceptRoutes[host] {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return acceptRoutes[h]
+	}
+	return false
+}
+
+type routesNotice struct {
+	Routes []string `json:"routes"`
+}
+
+func handleRoutes(c *Client, data json.RawMessage) error {
+	rn := &routesNotice{}
+	if err := json.Unmarshal(data, rn); err != nil {
+		return err
+	}
+	var accepted, dropped []string
+	for _, host := range rn.Routes {
+		if acceptRoute(host) {
+			accepted = append(accepted, host)
+		} else {
+			dropped = append(dropped, host)
+		}
+	}
+	if len(dropped) != 0 {
+		atom.Log.Warnf("%v|peer %s announced routes not accepted: %v", c.ID, c.Name, dropped)
+	}
+	c.Lock()
+	c.routes = accepted
+	c.Unlock()
+	atom.Log.Infof("%v|peer %s announced routes: %v", c.ID, c.Name, accepted)
+	return nil
+}
+
+// announce advertises the capabilities and routes of this node to the peer
+// right after connected.
+func (c *Client) announce() {
+	if !c.hasCap(packet.CapNotice) {
+		return
+	}
+	adv := &advertiseNotice{
+		Version: packet.Version,
+		Caps:    uint32(packet.Capabilities),
+		Codecs:  codecPrefs,
+		Timeout: int(requestTimeout / time.Second),
+	}
+	if err := c.SendNotice(NoticeAdvertise, adv); err != nil {
+		atom.Log.Warnf("%v|advertise failed: %v", c.ID, err)
+	}
+	if len(routes) != 0 {
+		if err := c.SendNotice(NoticeRoutes, &routesNotice{Routes: routes}); err != nil {
+			atom.Log.Warnf("%v|announce routes failed: %v", c.ID, err)
+		}
+	}
+	if c.addr != "" {
+		// only the dialing side asks the peer to listen
+		c.requestListens()
+	}
+}
+
+// ping sends a ping notice to probe the latency of connection.
+func (c *Client) ping() {
+	if !c.hasCap(packet.CapNotice) {
+		return
+	}
+	if err := c.SendNotice(NoticePing, &pingNotice{Sent: time.Now().UnixNano()}); err != nil {
+		atom.Log.Warnf("%v|ping failed: %v", c.ID, err)
+	}
+}
+
+// hasCap reports whether the peer supports capability cap.
+func (c *Client) hasCap(cap packet.Capability) bool {
+	return c.Capabilities&cap != 0
+}
+
+// Latency returns the round trip time of connection measured by the latest
+// ping notice, 0 if not measured yet.
+func (c *Client) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.latency))
+}
+
+// routesTo reports whether the peer announced host as reachable. host
+// matches a route either with or without port.
+func (c *Client) routesTo(host string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, r := range c.routes {
+		if r == host || r == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// Drain announces to all peers that this node is shutting down, and waits
+// until requests in both directions are finished or timeout.
+func (h *hub) Drain(timeout time.Duration) {
+	h.RLock()
+	clients := append([]*Client(nil), h.list...)
+	h.RUnlock()
+	for _, c := range clients {
+		atomic.StoreInt32(&c.draining, 1)
+		if err := c.SendNotice(NoticeDraining, struct{}{}); err != nil {
+			atom.Log.Warnf("%v|announce draining failed: %v", c.ID, err)
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		busy := 0
+		for _, c := range clients {
+			busy += c.pending()
+		}
+		if busy == 0 {
+			return
+		}
+		atom.Log.Infof("draining, %d requests pending", busy)
+		time.Sleep(100 * time.Millisecond)
+	}
+	atom.Log.Warnf("drain timeout after %v", timeout)
+}
+
+// pending returns the number of requests in both directions on the
+// connection.
+func (c *Client) pending() int {
+	c.RLock()
+	defer c.RUnlock()
+	return int(atomic.LoadInt32(&c.inflight)) + len(c.requests)
+}
@@ -0,0 +1,101 @@
+package ws
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Wenchy/bifrost/internal/packet"
+)
+
+func TestNotice(t *testing.T) {
+	c := newLoopClient(1, "dc-east")
+	var got string
+	RegisterNotice("test", func(c *Client, data json.RawMessage) error {
+		return json.Unmarshal(data, &got)
+	})
+	if err := c.SendNotice("test", "hello"); err != nil {
+		t.Fatalf("SendNotice() error = %v", err)
+	}
+	Hub.handleNotice(c, sentPacket(t, c))
+	if got != "hello" {
+		t.Errorf("notice data = %q, want %q", got, "hello")
+	}
+
+	// ping is answered by pong, which measures latency
+	c.ping()
+	for i := 0; i < 2; i++ {
+		Hub.handleNotice(c, sentPacket(t, c))
+	}
+	if c.Latency() <= 0 {
+		t.Errorf("Latency() = %v, want > 0", c.Latency())
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	c := newLoopClient(1, "dc-east")
+	SetAcceptRoutes([]string{"api.internal", "10.0.0.1:8080"})
+	defer SetAcceptRoutes(nil)
+
+	// capabilities advertised are not taken after login
+	if err := handleAdvertise(c, json.RawMessage(`{"version":3,"caps":0}`)); err != nil {
+		t.Fatalf("handleAdvertise() error = %v", err)
+	}
+	if c.Capabilities != packet.Capabilities {
+		t.Errorf("Capabilities = %#x, want %#x", c.Capabilities, packet.Capabilities)
+	}
+
+	data := json.RawMessage(`{"routes":["api.internal:8080","10.0.0.1:8080","10.0.0.1:9090","example.com"]}`)
+	if err := handleRoutes(c, data); err != nil {
+		t.Fatalf("handleRoutes() error = %v", err)
+	}
+	want := []string{"api.internal:8080", "10.0.0.1:8080"}
+	if !reflect.DeepEqual(c.routes, want) {
+		t.Errorf("routes = %v, want %v", c.routes, want)
+	}
+
+	// ping is not answered while the send queue is full, instead of blocking
+	for len(c.sendCh) < cap(c.sendCh) {
+		c.sendCh <- &frame{}
+	}
+	if err := handlePing(c, json.RawMessage(`{"sent":1}`)); err != errSendQueueFull {
+		t.Errorf("handlePing() error = %v, want %v", err, errSendQueueFull)
+	}
+}
+
+func TestPick(t *testing.T) {
+	h := NewDefaultHub()
+	east := newLoopClient(1, "dc-east")
+	west := newLoopClient(2, "dc-west")
+	west.routes = []string{"api.internal"}
+	h.list = []*Client{east, west}
+
+	for _, tt := range []struct {
+		name     string
+		peer     string
+		host     string
+		draining *Client
+		want     *Client
+		wantErr  bool
+	}{
+		{name: "by name", peer: "dc-east", want: east},
+		{name: "by route", host: "api.internal:8080", want: west},
+		{name: "route of named peer ignored", peer: "dc-east", host: "api.internal", want: east},
+		{name: "draining skipped", draining: east, peer: "", host: "other", want: west},
+		{name: "named peer draining", draining: east, peer: "dc-east", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			east.draining, west.draining = 0, 0
+			if tt.draining != nil {
+				tt.draining.draining = 1
+			}
+			got, err := h.pick(tt.peer, tt.host)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pick() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("pick() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Wenchy/bifrost/internal/atom"
+)
+
+// Reverse port forwarding: the dialing side asks the peer to listen on an
+// address by a listen notice, and the peer opens a reverse stream back for
+// each connection accepted, which is piped with the local target.
+
+// Kinds of notices and streams of reverse port forwarding.
+const (
+	NoticeListen   = "listen"   // ask the peer to listen on an address
+	NoticeListened = "listened" // result of listen
+	StreamReverse  = "reverse"  // connection accepted by the listener of peer
+)
+
+func init() {
+	RegisterNotice(NoticeListen, handleListen)
+	RegisterNotice(NoticeListened, handleListened)
+	RegisterStream(StreamReverse, handleReverseStream)
+}
+
+// local targets by the address listened on by the peer, see
+// SetReverseForwards.
+var reverseForwards map[string]string
+
+// SetReverseForwards sets the addresses the peer is asked to listen on, and
+// the local targets("host:port") dialed for connections accepted by them.
+func SetReverseForwards(forwards map[string]string) {
+	reverseForwards = forwards
+}
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	min, max int
+}
+
+// ports allowed to listen on by peers, keyed by the common name or subject of
+// the peer's verified certificate, and "*" for any peer, see SetReversePorts.
+var reversePorts map[string][]portRange
+
+// SetReversePorts sets the ports each peer is allowed to ask this node to
+// listen on, keyed by the common name or full subject of the peer's verified
+// client certificate, or "*" for any peer. The login name is not trusted, as
+// any peer knowing the key and token can present it. A port is either a
+// number or a range, e.g.: "2222" or "8000-8100". No port is allowed by
+// default.
+func SetReversePorts(ports map[string][]string) error {
+	allowed := map[string][]portRange{}
+	for name, list := range ports {
+		for _, p := range list {
+			r, err := parsePortRange(p)
+			if err != nil {
+				return err
+			}
+			allowed[name] = append(allowed[name], r)
+		}
+	}
+	reversePorts = allowed
+	return nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	min, err1 := strconv.Atoi(strings.TrimSpace(lo))
+	max, err2 := strconv.Atoi(strings.TrimSpace(hi))
+	if err1 != nil || err2 != nil || min < 1 || max > 65535 || min > max {
+		return portRange{}, fmt.Errorf("invalid port range: %q", s)
+	}
+	return portRange{min: min, max: max}, nil
+}
+
+// allowListen checks whether the peer of c is allowed to ask this node to
+// listen on addr.
+func allowListen(c *Client, addr string) error {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return fmt.Errorf("invalid port: %q", p)
+	}
+	for _, key := range peerKeys(c) {
+		for _, r := range reversePorts[key] {
+			if port >= r.min && port <= r.max {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("port %d not allowed for peer %s, subject: %q", port, c.Name, c.Subject)
+}
+
+// peerKeys returns the keys of allowlists which the peer of c matches: "*",
+// and the subject and common name of its verified certificate if any.
+func peerKeys(c *Client) []string {
+	keys := []string{"*"}
+	if c.Subject != "" {
+		keys = append(keys, c.Subject, c.CommonName)
+	}
+	return keys
+}
+
+type listenNotice struct {
+	Addr  string `json:"addr"`
+	Error string `json:"error,omitempty"` // why listen failed, only in listened
+}
+
+// requestListens asks the peer to listen on the addresses of reverse
+// forwards, right after connected.
+func (c *Client) requestListens() {
+	for addr := range reverseForwards {
+		if err := c.SendNotice(NoticeListen, &listenNotice{Addr: addr}); err != nil {
+			atom.Log.Warnf("%v|request listen on %s failed: %v", c.ID, addr, err)
+		}
+	}
+}
+
+func handleListen(c *Client, data json.RawMessage) error {
+	ln := &listenNotice{}
+	if err := json.Unmarshal(data, ln); err != nil {
+		return err
+	}
+	result := &listenNotice{Addr: ln.Addr}
+	if err := listen(c, ln.Addr); err != nil {
+		atom.Log.Warnf("%v|peer %s denied to listen on %s: %v", c.ID, c.Name, ln.Addr, err)
+		result.Error = err.Error()
+	}
+	// the result must not be dropped, so it is sent without blocking the
+	// dispatching goroutine instead
+	go func() {
+		if err := c.SendNotice(NoticeListened, result); err != nil {
+			atom.Log.Warnf("%v|reply listen on %s failed: %v", c.ID, ln.Addr, err)
+		}
+	}()
+	return nil
+}
+
+func handleListened(c *Client, data json.RawMessage) error {
+	ln := &listenNotice{}
+	if err := json.Unmarshal(data, ln); err != nil {
+		return err
+	}
+	if ln.Error != "" {
+		atom.Log.Errorf("%v|peer %s failed to listen on %s: %s", c.ID, c.Name, ln.Addr, ln.Error)
+		return nil
+	}
+	atom.Log.Infof("%v|peer %s listening on %s, forwarded to %s", c.ID, c.Name, ln.Addr, reverseForwards[ln.Addr])
+	return nil
+}
+
+// handleReverseStream dials the local target of the address listened on by
+// the peer, and pipes the stream with the connection.
+func handleReverseStream(s *Stream, addr string) error {
+	target, ok := reverseForwards[addr]
+	if !ok {
+		return &tunnelError{code: errCodeRouteDenied, msg: "not forwarded: " + addr}
+	}
+	return dialStream(s, target)
+}
+
+// reverseListener listens on an address for the clients connected to a peer,
+// and is closed once all of them are disconnected.
+type reverseListener struct {
+	ln      net.Listener
+	addr    string
+	name    string // name of the peer
+	subject string // verified subject of the peer
+	clients []*Client
+	next    uint32 // next index of clients to pick by round robin
+}
+
+var (
+	listenerMu sync.Mutex
+	listeners  = map[string]*reverseListener{}
+)
+
+// listen listens on addr for the peer of c if allowed. The clients connected
+// to the same peer share the listener.
+func listen(c *Client, addr string) error {
+	if err := allowListen(c, addr); err != nil {
+		return err
+	}
+	listenerMu.Lock()
+	defer listenerMu.Unlock()
+	if rl, ok := listeners[addr]; ok {
+		if rl.name != c.Name || rl.subject != c.Subject {
+			return fmt.Errorf("%s already listened for peer %s", addr, rl.name)
+		}
+		for _, client := range rl.clients {
+			if client == c {
+				return nil
+			}
+		}
+		rl.clients = append(rl.clients, c)
+		return nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	rl := &reverseListener{ln: ln, addr: addr, name: c.Name, subject: c.Subject, clients: []*Client{c}}
+	listeners[addr] = rl
+	atom.Log.Infof("%v|listen on %s for peer %s", c.ID, addr, c.Name)
+	go rl.serve()
+	return nil
+}
+
+// unlisten removes c from the listeners, and closes those without clients.
+func unlisten(c *Client) {
+	listenerMu.Lock()
+	defer listenerMu.Unlock()
+	for addr, rl := range listeners {
+		for i, client := range rl.clients {
+			if client == c {
+				rl.clients = append(rl.clients[:i], rl.clients[i+1:]...)
+				break
+			}
+		}
+		if len(rl.clients) == 0 {
+			atom.Log.Infof("%v|stop listening on %s for peer %s", c.ID, addr, rl.name)
+			rl.ln.Close()
+			delete(listeners, addr)
+		}
+	}
+}
+
+// pick picks a client of the listener in turn, nil if none.
+func (rl *reverseListener) pick() *Client {
+	listenerMu.Lock()
+	defer listenerMu.Unlock()
+	if len(rl.clients) == 0 {
+		return nil
+	}
+	rl.next++
+	return rl.clients[int(rl.next)%len(rl.clients)]
+}
+
+// serve opens a reverse stream to the peer for each connection accepted.
+func (rl *reverseListener) serve() {
+	for {
+		conn, err := rl.ln.Accept()
+		if err != nil {
+			atom.Log.Warnf("%s|accept failed: %v", rl.addr, err)
+			return
+		}
+		go func() {
+			c := rl.pick()
+			if c == nil {
+				conn.Close()
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			s, err := c.OpenStream(ctx, StreamReverse, rl.addr)
+			cancel()
+			if err != nil {
+				atom.Log.Errorf("%v|%s|open reverse stream failed: %v", c.ID, rl.addr, err)
+				conn.Close()
+				return
+			}
+			pipe(conn, s)
+		}()
+	}
+}
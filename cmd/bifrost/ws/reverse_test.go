@@ -0,0 +1,83 @@
+package ws
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAllowListen(t *testing.T) {
+	if err := SetReversePorts(map[string][]string{"dc-west": {"2222"}, "CN=dc-west,O=bifrost": {"8000-8100"}, "*": {"9000"}}); err != nil {
+		t.Fatalf("SetReversePorts() error = %v", err)
+	}
+	defer SetReversePorts(nil)
+	west := &Client{Name: "dc-west", Subject: "CN=dc-west,O=bifrost", CommonName: "dc-west"}
+	// presenting the name without the certificate
+	spoofer := &Client{Name: "dc-west"}
+	for _, tt := range []struct {
+		c    *Client
+		addr string
+		ok   bool
+	}{
+		{c: west, addr: ":2222", ok: true},
+		{c: west, addr: "127.0.0.1:8050", ok: true},
+		{c: west, addr: ":8101", ok: false},
+		{c: west, addr: ":9000", ok: true},
+		{c: spoofer, addr: ":2222", ok: false},
+		{c: spoofer, addr: ":8050", ok: false},
+		{c: spoofer, addr: ":9000", ok: true},
+		{c: spoofer, addr: "9000", ok: false},
+	} {
+		if err := allowListen(tt.c, tt.addr); (err == nil) != tt.ok {
+			t.Errorf("allowListen(%s, %s) error = %v, want ok %v", tt.c.Subject, tt.addr, err, tt.ok)
+		}
+	}
+	for _, p := range []string{"0", "80-70", "65536", "ssh"} {
+		if err := SetReversePorts(map[string][]string{"*": {p}}); err == nil {
+			t.Errorf("SetReversePorts(%q) succeeded", p)
+		}
+	}
+}
+
+func TestReverseForward(t *testing.T) {
+	target := echoServer(t)
+	// a free port to be listened on by the peer
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	addr := free.Addr().String()
+	free.Close()
+
+	SetReversePorts(map[string][]string{"*": {"1-65535"}})
+	SetReverseForwards(map[string]string{addr: target})
+	defer SetReversePorts(nil)
+	defer SetReverseForwards(nil)
+	dialPair(t)
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	data := bytes.Repeat([]byte("reverse"), 100*1024)
+	go func() {
+		conn.Write(data)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("echoed %d bytes, want %d", len(got), len(data))
+	}
+}
@@ -1,30 +1,81 @@
 package ws
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/Wenchy/bifrost/internal/atom"
+	"github.com/Wenchy/bifrost/internal/packet"
+	"github.com/gorilla/websocket"
 )
 
+// HTTP header of the websocket handshake carrying the protocol version, so
+// that incompatible peers are rejected before any packet is exchanged.
+const versionHeader = "X-Bifrost-Version"
+
+// checkPeerVersion checks the protocol version in the handshake header h of
+// the peer, which is version 1 if absent.
+func checkPeerVersion(h http.Header) error {
+	v := h.Get(versionHeader)
+	if v == "" {
+		return &packet.VersionError{Version: 1}
+	}
+	version, err := strconv.ParseUint(v, 10, 8)
+	if err != nil {
+		return fmt.Errorf("invalid protocol version: %s", v)
+	}
+	return packet.CheckVersion(uint8(version))
+}
+
+// rejectConn tells the peer why it is rejected by a close message, and closes
+// the connection.
+func rejectConn(conn *websocket.Conn, err error) {
+	msg := websocket.FormatCloseMessage(websocket.CloseProtocolError, "bifrost: "+err.Error())
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait)); err != nil {
+		atom.Log.Warnf("write close message failed: %v", err)
+	}
+	conn.Close()
+}
+
 // serveWS handles websocket requests from the peer.
 func ServeWS(w http.ResponseWriter, r *http.Request) {
+	// reject unknown peers before upgrading
+	subject, commonName, err := verifyPeer(r)
+	if err != nil {
+		atom.Log.Warnf("%s|reject peer %s: %v", subject, r.RemoteAddr, err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if err := checkPeerVersion(r.Header); err != nil {
+		atom.Log.Warnf("%s|reject peer %s: %v", subject, r.RemoteAddr, err)
+		http.Error(w, "bifrost: "+err.Error(), http.StatusUpgradeRequired)
+		return
+	}
 	upgrader.CheckOrigin = func(r *http.Request) bool {
 		return true
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	header := http.Header{versionHeader: {strconv.Itoa(int(packet.Version))}}
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		atom.Log.Warnf("websocket upgrade failed: %s", err)
 		return
 	}
 	// When a new client connect in, ID is 0. After successfully login, response packet will give the client's ID.
-	client := &Client{
-		ID:           0, // TODO: generate unique ID
-		conn:         conn,
-		sendCh:       make(chan []byte, 256),
-		sendChClosed: false,
-		responsers:   map[uint32]*Responser{},
-	}
-	atom.Log.Debugf("new client: %p", client)
+	client := newClient(conn, "")
+	client.Subject = subject
+	client.CommonName = commonName
+	atom.Log.Debugf("new client: %p, subject: %s, addr: %s", client, subject, r.RemoteAddr)
+	if err := client.acceptLogin(); err != nil {
+		atom.Log.Warnf("%p|login failed: %v", client, err)
+		if _, ok := err.(*packet.VersionError); ok {
+			rejectConn(conn, err)
+			return
+		}
+		conn.Close()
+		return
+	}
 
 	client.Run()
 }
@@ -0,0 +1,265 @@
+package ws
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Wenchy/bifrost/internal/atom"
+	"github.com/Wenchy/bifrost/internal/packet"
+)
+
+// Number of latest counters remembered to detect replays. A counter below the
+// highest received one is still accepted once if it is in the window.
+const replayWindowSize = 1024
+
+// Size of the counter prepended to the plaintext of each payload.
+const counterSize = 8
+
+// errReplay is returned when unsealing a payload which has been received.
+var errReplay = errors.New("replayed payload")
+
+// errNotEncrypted is returned when a payload received is not encrypted.
+var errNotEncrypted = errors.New("payload not encrypted")
+
+// number of replayed payloads detected, accessed atomically
+var replayCount uint64
+
+// session holds the keys, the codec and the replay protection state of a
+// connection, which is set up when login.
+type session struct {
+	sendKeys    *Keyring
+	recvKeys    *Keyring
+	codec       Codec  // negotiated codec to compress packets sent
+	sendCounter uint64 // last counter sent, accessed atomically
+	window      replayWindow
+}
+
+func newSession(sendKeys, recvKeys *Keyring, codec Codec) *session {
+	return &session{
+		sendKeys: sendKeys,
+		recvKeys: recvKeys,
+		codec:    codec,
+	}
+}
+
+// frame is a packet queued to be written. The payload of a sealed frame is
+// compressed when queued, and encrypted with the next counter right before
+// written, so that counters are sent in order and never fall behind the
+// replay window of the peer, however long the frame waits in queue.
+type frame struct {
+	pkt    *packet.Packet
+	sealed bool   // whether buf is sealed as the payload of pkt
+	codec  Codec  // codec the payload is compressed by
+	buf    []byte // room for the counter followed by the compressed payload
+}
+
+// frame compresses raw as the payload of pkt to be sealed. It is compressed
+// by the negotiated codec only if compress is true and raw is not too small.
+func (s *session) frame(pkt *packet.Packet, raw []byte, compress bool) (*frame, error) {
+	codec := s.codec
+	if !compress || len(raw) < compressMinSize {
+		codec = noneCodec{}
+	}
+	zipped, err := codec.Compress(raw)
+	if err != nil {
+		atom.Log.Errorf("compress failed: %s", err)
+		return nil, err
+	}
+	// copied, as raw may be reused by the caller before sealed
+	buf := make([]byte, counterSize+len(zipped))
+	copy(buf[counterSize:], zipped)
+	return &frame{pkt: pkt, sealed: true, codec: codec, buf: buf}, nil
+}
+
+// charge returns the credit charged for the packet of f once sealed.
+func (f *frame) charge() int {
+	if !f.sealed {
+		return charge(f.pkt)
+	}
+	return packet.HeaderSize + cipherOverhead + len(f.buf)
+}
+
+// seal prepends a monotonic counter to the compressed payload of f, and then
+// encrypts it as the payload of its packet, so the counter is authenticated.
+func (s *session) seal(f *frame) error {
+	counter := atomic.AddUint64(&s.sendCounter, 1)
+	binary.BigEndian.PutUint64(f.buf, counter)
+	return encrypt(s.sendKeys, f.codec, f.pkt, f.buf)
+}
+
+// open decrypts the payload of pkt in place, and returns errReplay if its
+// counter has been received or is too old. It is called by the dispatcher in
+// the order packets are received, as payloads waiting to be read could fall
+// behind the replay window otherwise. The payload size in header is kept, by
+// which body chunks are charged.
+func (s *session) open(pkt *packet.Packet) error {
+	_, buf, err := decrypt(s.recvKeys, pkt)
+	if err != nil {
+		return err
+	}
+	if len(buf) < counterSize {
+		return errors.New("payload too short")
+	}
+	counter := binary.BigEndian.Uint64(buf)
+	if !s.window.check(counter) {
+		n := atomic.AddUint64(&replayCount, 1)
+		atom.Log.Warnf("replayed payload dropped, counter: %d, total replays: %d", counter, n)
+		return errReplay
+	}
+	pkt.Payload = buf[counterSize:]
+	pkt.Header.Flags &^= packet.FlagEncrypted
+	return nil
+}
+
+// unseal opens pkt if not opened yet, and decompresses its payload. Packets
+// received are opened by the dispatcher, which rejects payloads not
+// encrypted.
+func (s *session) unseal(pkt *packet.Packet) ([]byte, error) {
+	if pkt.Header.Flags&packet.FlagEncrypted != 0 {
+		if err := s.open(pkt); err != nil {
+			return nil, err
+		}
+	}
+	codec, err := payloadCodec(pkt)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := codec.Decompress(pkt.Payload)
+	if err != nil {
+		atom.Log.Errorf("decompress failed: %s", err)
+		return nil, err
+	}
+	return raw, nil
+}
+
+// seal compresses raw by codec and encrypts it by the active key of kr, as
+// the payload of pkt to be sent through the tunnel.
+func seal(kr *Keyring, codec Codec, pkt *packet.Packet, raw []byte) error {
+	zipped, err := codec.Compress(raw)
+	if err != nil {
+		atom.Log.Errorf("compress failed: %s", err)
+		return err
+	}
+	return encrypt(kr, codec, pkt, zipped)
+}
+
+// encrypt encrypts zipped compressed by codec by the active key of kr, as the
+// payload of pkt.
+func encrypt(kr *Keyring, codec Codec, pkt *packet.Packet, zipped []byte) error {
+	ciphered, err := Encrypt(kr, zipped)
+	if err != nil {
+		atom.Log.Errorf("encrypt failed: %s", err)
+		return err
+	}
+	pkt.Header.Flags |= packet.FlagEncrypted
+	if codec.ID() != codecIDNone {
+		pkt.Header.Flags |= packet.FlagCompressed
+	}
+	pkt.Header.Codec = codec.ID()
+	pkt.Header.Size = uint32(len(ciphered))
+	pkt.Payload = ciphered
+	return nil
+}
+
+// unseal decrypts the payload of pkt received from the tunnel by the keys of
+// kr, and decompresses it by the codec in the packet header if flagged.
+func unseal(kr *Keyring, pkt *packet.Packet) ([]byte, error) {
+	codec, zipped, err := decrypt(kr, pkt)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := codec.Decompress(zipped)
+	if err != nil {
+		atom.Log.Errorf("decompress failed: %s", err)
+		return nil, err
+	}
+	return raw, nil
+}
+
+// decrypt decrypts the payload of pkt by the keys of kr, and returns it with
+// the codec it is compressed by.
+func decrypt(kr *Keyring, pkt *packet.Packet) (Codec, []byte, error) {
+	if pkt.Header.Flags&packet.FlagEncrypted == 0 {
+		return nil, nil, errNotEncrypted
+	}
+	codec, err := payloadCodec(pkt)
+	if err != nil {
+		return nil, nil, err
+	}
+	zipped, err := Decrypt(kr, pkt.Payload)
+	if err != nil {
+		atom.Log.Errorf("decrypt failed: %s", err)
+		return nil, nil, err
+	}
+	return codec, zipped, nil
+}
+
+// payloadCodec returns the codec the payload of pkt is compressed by.
+func payloadCodec(pkt *packet.Packet) (Codec, error) {
+	if pkt.Header.Flags&packet.FlagCompressed == 0 {
+		return noneCodec{}, nil
+	}
+	codec, ok := codecs[pkt.Header.Codec]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec ID: %d", pkt.Header.Codec)
+	}
+	return codec, nil
+}
+
+// replayWindow is a sliding window of received counters.
+type replayWindow struct {
+	sync.Mutex
+	top    uint64 // highest counter received
+	bitmap [replayWindowSize / 64]uint64
+}
+
+// check reports whether counter is not received yet and not too old, and
+// marks it as received.
+func (w *replayWindow) check(counter uint64) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	if counter == 0 {
+		// counters start from 1
+		return false
+	}
+	if counter > w.top {
+		// slide the window, and clear the bits of skipped counters
+		if counter-w.top >= replayWindowSize {
+			w.bitmap = [replayWindowSize / 64]uint64{}
+		} else {
+			for i := w.top + 1; i < counter; i++ {
+				w.clear(i)
+			}
+		}
+		w.top = counter
+		w.mark(counter)
+		return true
+	}
+	if w.top-counter >= replayWindowSize {
+		return false
+	}
+	if w.marked(counter) {
+		return false
+	}
+	w.mark(counter)
+	return true
+}
+
+func (w *replayWindow) mark(counter uint64) {
+	i := counter % replayWindowSize
+	w.bitmap[i/64] |= 1 << (i % 64)
+}
+
+func (w *replayWindow) clear(counter uint64) {
+	i := counter % replayWindowSize
+	w.bitmap[i/64] &^= 1 << (i % 64)
+}
+
+func (w *replayWindow) marked(counter uint64) bool {
+	i := counter % replayWindowSize
+	return w.bitmap[i/64]&(1<<(i%64)) != 0
+}
@@ -0,0 +1,133 @@
+package ws
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/Wenchy/bifrost/internal/packet"
+)
+
+func TestReplayWindow(t *testing.T) {
+	w := &replayWindow{}
+	for _, tt := range []struct {
+		name    string
+		counter uint64
+		want    bool
+	}{
+		{name: "zero", counter: 0, want: false},
+		{name: "first", counter: 1, want: true},
+		{name: "duplicate", counter: 1, want: false},
+		{name: "skip ahead", counter: 5, want: true},
+		{name: "out of order", counter: 3, want: true},
+		{name: "out of order duplicate", counter: 3, want: false},
+		{name: "slide window", counter: 5 + replayWindowSize, want: true},
+		{name: "too old", counter: 5, want: false},
+		{name: "oldest in window", counter: 6, want: true},
+		{name: "cleared after slide", counter: 4 + replayWindowSize, want: true},
+		{name: "jump over window", counter: 10 * replayWindowSize, want: true},
+		{name: "cleared after jump", counter: 10*replayWindowSize - 1, want: true},
+	} {
+		if got := w.check(tt.counter); got != tt.want {
+			t.Errorf("%s: check(%d) = %v, want %v", tt.name, tt.counter, got, tt.want)
+		}
+	}
+}
+
+func TestSessionReplay(t *testing.T) {
+	sender := newSession(testKeyring, testKeyring, defaultCodec)
+	receiver := newSession(testKeyring, testKeyring, defaultCodec)
+
+	// long enough to be compressed
+	input := bytes.Repeat([]byte("To be encrypted content."), 20)
+	pkt := packet.NewSeqPacket(packet.PacketTypeRequest, 1, nil)
+	f, err := sender.frame(pkt, input, true)
+	if err != nil {
+		t.Fatalf("frame() error = %v", err)
+	}
+	if err := sender.seal(f); err != nil {
+		t.Fatalf("seal() error = %v", err)
+	}
+	if charge(pkt) != f.charge() {
+		t.Errorf("charge() = %d, sealed %d", f.charge(), charge(pkt))
+	}
+	buf, err := packet.Encode(pkt)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	received := func() *packet.Packet {
+		pkt, err := packet.Parse(buf)
+		if err != nil {
+			t.Fatalf("Parse() error = %v", err)
+		}
+		return pkt
+	}
+	output, err := receiver.unseal(received())
+	if err != nil {
+		t.Fatalf("unseal() error = %v", err)
+	}
+	if !reflect.DeepEqual(output, input) {
+		t.Errorf("unseal() = %v, want %v", output, input)
+	}
+	if _, err := receiver.unseal(received()); err != errReplay {
+		t.Errorf("unseal() replayed error = %v, want %v", err, errReplay)
+	}
+}
+
+func TestFrameSealedWhenWritten(t *testing.T) {
+	sender := newSession(testKeyring, testKeyring, defaultCodec)
+	receiver := newSession(testKeyring, testKeyring, defaultCodec)
+
+	// a frame waiting in queue while more than the replay window of packets
+	// are written ahead of it
+	queued, err := sender.frame(packet.NewSeqPacket(packet.PacketTypeStreamData, 1, nil), []byte("queued"), false)
+	if err != nil {
+		t.Fatalf("frame() error = %v", err)
+	}
+	for i := 0; i < 2*replayWindowSize; i++ {
+		f, err := sender.frame(packet.NewSeqPacket(packet.PacketTypeWindow, 0, nil), []byte("window"), false)
+		if err != nil {
+			t.Fatalf("frame() error = %v", err)
+		}
+		if err := sender.seal(f); err != nil {
+			t.Fatalf("seal() error = %v", err)
+		}
+		if _, err := receiver.unseal(f.pkt); err != nil {
+			t.Fatalf("unseal() error = %v", err)
+		}
+	}
+	if err := sender.seal(queued); err != nil {
+		t.Fatalf("seal() error = %v", err)
+	}
+	if output, err := receiver.unseal(queued.pkt); err != nil || string(output) != "queued" {
+		t.Errorf("unseal() = %q, %v, want queued", output, err)
+	}
+}
+
+func TestControlPacketsSealed(t *testing.T) {
+	c := newLoopClient(1, "dc-east")
+
+	// packets without payload are sealed too, so they can not be replayed
+	if err := c.sendBody(packet.PacketTypeRequestBody, packet.PacketTypeRequestEnd, 7, nil, false, nil); err != nil {
+		t.Fatalf("sendBody() error = %v", err)
+	}
+	if pkt := sentPacket(t, c); pkt.Header.Flags&packet.FlagEncrypted == 0 {
+		t.Errorf("end of body sent not encrypted")
+	}
+	if err := c.sendStreamFrame(packet.PacketTypeStreamClose, 3); err != nil {
+		t.Fatalf("sendStreamFrame() error = %v", err)
+	}
+	c.sendCh <- c.sched.pop()
+	if pkt := sentPacket(t, c); pkt.Header.Flags&packet.FlagEncrypted == 0 {
+		t.Errorf("stream close sent not encrypted")
+	}
+
+	// an end of body not encrypted fails the body instead of ending it
+	in := c.newInbound(7)
+	end := packet.NewSeqPacket(packet.PacketTypeRequestEnd, 7, nil)
+	end.Header.ID = c.ID
+	Hub.dispatchPacket(c, end)
+	if _, err := in.body.Read(make([]byte, 1)); err != errNotEncrypted {
+		t.Errorf("Read() error = %v, want %v", err, errNotEncrypted)
+	}
+}
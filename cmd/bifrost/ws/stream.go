@@ -0,0 +1,301 @@
+package ws
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Wenchy/bifrost/internal/atom"
+	"github.com/Wenchy/bifrost/internal/packet"
+)
+
+// Size of body chunk read at a time, which is sent as one packet.
+const chunkSize = 32 * 1024
+
+var (
+	errPipeClosed = errors.New("pipe closed")
+	errPipeDone   = errors.New("pipe done")
+	errPipeFull   = errors.New("pipe full")
+)
+
+// packetPipe delivers the packets of a request from the hub's dispatcher to
+// the goroutine handling it, in the order they are received. Pushing never
+// blocks the dispatcher, and the packets buffered are bounded by the credits
+// of flow control, or by limit if the peer does not support it.
+type packetPipe struct {
+	mu     sync.Mutex
+	queue  []*packet.Packet
+	limit  int // max packets buffered, 0 if bounded by credits
+	closed bool
+	pushed chan struct{} // signaled when a packet is pushed
+
+	aborted   chan struct{}
+	abortErr  error
+	abortOnce sync.Once
+}
+
+func newPacketPipe(limit int) *packetPipe {
+	return &packetPipe{
+		limit:   limit,
+		pushed:  make(chan struct{}, 1),
+		aborted: make(chan struct{}),
+	}
+}
+
+// push delivers pkt, and drops it if the pipe is already closed. If limit is
+// reached, pkt is dropped and the pipe is aborted, as the consumer can not
+// keep up with a peer sending without flow control.
+func (p *packetPipe) push(pkt *packet.Packet) bool {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return false
+	}
+	if p.limit > 0 && len(p.queue) >= p.limit {
+		p.mu.Unlock()
+		p.abort(errPipeFull)
+		return false
+	}
+	p.queue = append(p.queue, pkt)
+	p.mu.Unlock()
+	select {
+	case p.pushed <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// shift returns the first packet buffered, nil if none.
+func (p *packetPipe) shift() (*packet.Packet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, errPipeClosed
+	}
+	if len(p.queue) == 0 {
+		return nil, nil
+	}
+	pkt := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	return pkt, nil
+}
+
+// pop waits for the next packet until the pipe is closed, aborted or done is
+// closed. Packets received before aborted are still popped.
+func (p *packetPipe) pop(done <-chan struct{}) (*packet.Packet, error) {
+	for {
+		pkt, err := p.shift()
+		if pkt != nil || err != nil {
+			return pkt, err
+		}
+		select {
+		case <-p.pushed:
+		case <-p.aborted:
+			if pkt, err := p.shift(); pkt != nil || err != nil {
+				return pkt, err
+			}
+			return nil, p.abortErr
+		case <-done:
+			return nil, errPipeDone
+		}
+	}
+}
+
+// abort tells the consumer that no more packets will be pushed because of err.
+func (p *packetPipe) abort(err error) {
+	p.abortOnce.Do(func() {
+		p.abortErr = err
+		close(p.aborted)
+	})
+}
+
+// close tells the dispatcher that no more packets will be popped, and returns
+// the packets dropped. The goroutine waiting in pop is woken up.
+func (p *packetPipe) close() []*packet.Packet {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	dropped := p.queue
+	p.queue = nil
+	select {
+	case p.pushed <- struct{}{}:
+	default:
+	}
+	return dropped
+}
+
+// bodyReader reads a body streamed from the peer as body chunk packets, which
+// is ended by an end-of-stream packet. The credit of chunks consumed or
+// dropped is granted back to the peer.
+type bodyReader struct {
+	// credit consumed but not granted yet, accessed atomically as Close may
+	// be called by another goroutine, and kept first for 64-bit alignment
+	unacked int64
+
+	pipe *packetPipe
+	c    *Client
+	typ  packet.PacketType // type of body chunk packets
+	seq  uint32
+	// connection credit granted for chunks pushed by pushWaiting, which is
+	// not granted again when they are consumed
+	mu      sync.Mutex
+	prepaid int
+	// stop waiting for the next chunk if the channel returned is closed, which
+	// is checked again by the next read
+	done func() <-chan struct{}
+	buf  []byte
+	err  error
+}
+
+func newBodyReader(pipe *packetPipe, c *Client, typ packet.PacketType, seq uint32, done func() <-chan struct{}) *bodyReader {
+	return &bodyReader{pipe: pipe, c: c, typ: typ, seq: seq, done: done}
+}
+
+// next returns the next non-empty chunk of body, or io.EOF at end of stream.
+func (r *bodyReader) next() ([]byte, error) {
+	for r.err == nil {
+		var done <-chan struct{}
+		if r.done != nil {
+			done = r.done()
+		}
+		pkt, err := r.pipe.pop(done)
+		if err == errPipeDone {
+			return nil, err
+		}
+		if err != nil {
+			r.err = err
+			break
+		}
+		switch pkt.Header.Type {
+		case packet.PacketTypeRequestEnd, packet.PacketTypeResponseEnd, packet.PacketTypeStreamClose:
+			r.err = io.EOF
+		default:
+			if n := atomic.AddInt64(&r.unacked, int64(charge(pkt))); n >= windowUpdateThreshold {
+				if atomic.CompareAndSwapInt64(&r.unacked, n, 0) {
+					r.grant(int(n))
+				}
+			}
+			// a replayed chunk fails the body rather than truncating it
+			chunk, err := r.c.session.unseal(pkt)
+			if err != nil {
+				r.err = err
+				break
+			}
+			if len(chunk) != 0 {
+				return chunk, nil
+			}
+		}
+	}
+	return nil, r.err
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		chunk, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = chunk
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Close drops the rest of the body, and grants back the credit not granted
+// yet.
+func (r *bodyReader) Close() error {
+	n := 0
+	for _, pkt := range r.pipe.close() {
+		if pkt.Header.Type == r.typ {
+			n += charge(pkt)
+		}
+	}
+	n += int(atomic.SwapInt64(&r.unacked, 0))
+	r.grant(n)
+	return nil
+}
+
+// pushWaiting pushes pkt like pipe.push while the request waits for a
+// worker, and grants back the connection credit of body chunks at once, so
+// that bodies waiting never take up the connection credit which the requests
+// being handled need. Each of them is still bounded by the stream credit.
+func (r *bodyReader) pushWaiting(pkt *packet.Packet) bool {
+	r.mu.Lock()
+	if !r.pipe.push(pkt) {
+		r.mu.Unlock()
+		return false
+	}
+	n := 0
+	if pkt.Header.Type == r.typ {
+		n = charge(pkt)
+		r.prepaid += n
+	}
+	r.mu.Unlock()
+	r.c.grant(r.typ, 0, n)
+	return true
+}
+
+// grant grants back n bytes of credit consumed or dropped, of which the
+// connection credit granted by pushWaiting is only granted to the stream.
+func (r *bodyReader) grant(n int) {
+	r.mu.Lock()
+	prepaid := r.prepaid
+	if prepaid > n {
+		prepaid = n
+	}
+	r.prepaid -= prepaid
+	r.mu.Unlock()
+	r.c.grantStream(r.typ, r.seq, prepaid)
+	r.c.grant(r.typ, r.seq, n-prepaid)
+}
+
+// sendBody streams body to the peer as body chunk packets of seq, followed by
+// an end-of-stream packet, which is also sent if reading body failed. Chunks
+// are compressed only if compress is true. Each chunk waits for the credit
+// granted by the peer until done is closed.
+func (c *Client) sendBody(bodyType, endType packet.PacketType, seq uint32, body io.Reader, compress bool, done <-chan struct{}) error {
+	key := streamKey{typ: bodyType, seq: seq}
+	c.openStreamCredit(key)
+	defer c.closeStreamCredit(key)
+	var rerr error
+	if body != nil {
+		buf := make([]byte, chunkSize)
+		for {
+			n, err := body.Read(buf)
+			if n > 0 {
+				pkt := packet.NewSeqPacket(bodyType, seq, nil)
+				pkt.Header.Flags |= packet.FlagStreaming
+				f, err := c.session.frame(pkt, buf[:n], compress)
+				if err != nil {
+					return err
+				}
+				if err := c.takeCredit(f, done); err != nil {
+					return err
+				}
+				if err := c.sendFrame(f, nil); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				atom.Log.Errorf("%d|read body failed: %v", seq, err)
+				rerr = err
+				break
+			}
+		}
+	}
+	end := packet.NewSeqPacket(endType, seq, nil)
+	end.Header.Flags |= packet.FlagStreaming | packet.FlagFinal
+	if err := c.sendSealed(end, nil, false); err != nil {
+		return err
+	}
+	return rerr
+}
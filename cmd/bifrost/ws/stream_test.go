@@ -0,0 +1,185 @@
+package ws
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/Wenchy/bifrost/internal/packet"
+)
+
+func TestBodyReaderReplay(t *testing.T) {
+	c := newLoopClient(1, "dc-east")
+	r := newBodyReader(newPacketPipe(0), c, packet.PacketTypeRequestBody, 7, nil)
+	f, err := c.session.frame(packet.NewSeqPacket(packet.PacketTypeRequestBody, 7, nil), []byte("chunk"), false)
+	if err != nil {
+		t.Fatalf("frame() error = %v", err)
+	}
+	if err := c.session.seal(f); err != nil {
+		t.Fatalf("seal() error = %v", err)
+	}
+	buf, err := packet.Encode(f.pkt)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	// the chunk replayed fails the body instead of being skipped
+	for i := 0; i < 2; i++ {
+		pkt, err := packet.Parse(buf)
+		if err != nil {
+			t.Fatalf("Parse() error = %v", err)
+		}
+		r.pipe.push(pkt)
+	}
+	r.pipe.push(packet.NewSeqPacket(packet.PacketTypeRequestEnd, 7, nil))
+	got, err := ioutil.ReadAll(r)
+	if err != errReplay {
+		t.Errorf("ReadAll() error = %v, want %v", err, errReplay)
+	}
+	if string(got) != "chunk" {
+		t.Errorf("ReadAll() = %q, want chunk", got)
+	}
+}
+
+func TestPacketPipeLimit(t *testing.T) {
+	p := newPacketPipe(2)
+	for i := 0; i < 2; i++ {
+		if !p.push(packet.NewSeqPacket(packet.PacketTypeRequestBody, 7, nil)) {
+			t.Fatalf("push() #%d dropped", i)
+		}
+	}
+	if p.push(packet.NewSeqPacket(packet.PacketTypeRequestBody, 7, nil)) {
+		t.Fatalf("push() beyond limit not dropped")
+	}
+	// packets buffered are still popped before the error
+	for i := 0; i < 2; i++ {
+		if _, err := p.pop(nil); err != nil {
+			t.Fatalf("pop() error = %v", err)
+		}
+	}
+	if _, err := p.pop(nil); err != errPipeFull {
+		t.Errorf("pop() error = %v, want %v", err, errPipeFull)
+	}
+}
+
+func TestBodyStreaming(t *testing.T) {
+	dialPeer(t, "test-body")
+	// larger than the connection window, so both sides wait for credit
+	data := make([]byte, 5*1024*1024+100)
+	rand.Read(data)
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/echo":
+			// echo by chunks flushed one by one
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for len(body) > 0 {
+				n := 64 * 1024
+				if n > len(body) {
+					n = len(body)
+				}
+				rw.Write(body[:n])
+				rw.(http.Flusher).Flush()
+				body = body[n:]
+			}
+		case "/early":
+			// respond before reading the whole body
+			io.ReadFull(req.Body, make([]byte, 10))
+			req.Body.Close()
+			io.WriteString(rw, "early")
+		}
+	}))
+	defer target.Close()
+	proxy := forwardServer(t, target.URL, "test-body")
+
+	for _, tt := range []struct {
+		name          string
+		path          string
+		contentLength bool
+		want          []byte
+	}{
+		{name: "sized", path: "/echo", contentLength: true, want: data},
+		{name: "chunked", path: "/echo", want: data},
+		{name: "closed early", path: "/early", contentLength: true, want: []byte("early")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// hide the size of a chunked body
+			var body io.Reader = struct{ io.Reader }{bytes.NewReader(data)}
+			if tt.contentLength {
+				body = bytes.NewReader(data)
+			}
+			req, err := http.NewRequest(http.MethodPost, proxy.URL+tt.path, body)
+			if err != nil {
+				t.Fatalf("NewRequest() error = %v", err)
+			}
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			defer rsp.Body.Close()
+			got, err := ioutil.ReadAll(rsp.Body)
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if rsp.StatusCode != http.StatusOK || !bytes.Equal(got, tt.want) {
+				t.Errorf("response = %d with %d bytes, want %d with %d bytes", rsp.StatusCode, len(got), http.StatusOK, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestWaitingUploads(t *testing.T) {
+	// one worker, so the other uploads wait for it with their bodies
+	// buffered, which must not take up the credit of the connection
+	if err := SetFlowControl(1, 0, "", 0); err != nil {
+		t.Fatalf("SetFlowControl() error = %v", err)
+	}
+	defer SetFlowControl(0, 0, "", 0)
+	dialPeer(t, "test-waiting")
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, req.Body)
+		fmt.Fprint(rw, n)
+	}))
+	defer target.Close()
+	proxy := forwardServer(t, target.URL, "test-waiting")
+
+	// uploads waiting in either direction of the pair fill more than the
+	// connection window by their stream windows
+	const uploads = 4 * connWindow / streamWindow
+	data := make([]byte, streamWindow+chunkSize)
+	rand.Read(data)
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodPost, proxy.URL, bytes.NewReader(data))
+			if err != nil {
+				t.Errorf("NewRequest() error = %v", err)
+				return
+			}
+			// long enough for all to be handled one by one, unless hung
+			req.Header.Set("X-Bifrost-Timeout", "30")
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("Do() error = %v", err)
+				return
+			}
+			defer rsp.Body.Close()
+			got, _ := ioutil.ReadAll(rsp.Body)
+			if rsp.StatusCode != http.StatusOK || string(got) != strconv.Itoa(len(data)) {
+				t.Errorf("response = %d %s, want %d %d", rsp.StatusCode, got, http.StatusOK, len(data))
+			}
+		}()
+	}
+	wg.Wait()
+}
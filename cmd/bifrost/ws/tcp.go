@@ -0,0 +1,150 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/Wenchy/bifrost/internal/atom"
+)
+
+// Kinds of built-in streams, more kinds can be added by RegisterStream.
+const (
+	StreamTCP = "tcp" // raw TCP connection to target dialed by the peer
+)
+
+func init() {
+	RegisterStream(StreamTCP, handleTCPStream)
+}
+
+// targets peers may ask this node to dial, keyed by the common name or
+// subject of the peer's verified certificate, and "*" for any peer, see
+// SetTCPTargets.
+var tcpTargets map[string][]string
+
+// SetTCPTargets sets the targets each peer is allowed to ask this node to
+// dial by TCP streams, e.g.: of tcp_forwards or CONNECT, keyed like
+// SetReversePorts. A target is either "host:port", or a host for any port of
+// it. No target is allowed by default.
+func SetTCPTargets(targets map[string][]string) {
+	tcpTargets = targets
+}
+
+// allowTarget checks whether the peer of c is allowed to ask this node to
+// dial target.
+func allowTarget(c *Client, target string) error {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	for _, key := range peerKeys(c) {
+		for _, t := range tcpTargets[key] {
+			if t == target || t == host {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("target %s not allowed for peer %s, subject: %q", target, c.Name, c.Subject)
+}
+
+// OpenStream opens a stream of kind to target through the peer of name, which
+// is picked like requests. If name is empty, any peer can be picked.
+func (h *hub) OpenStream(ctx context.Context, name, kind, target string) (*Stream, error) {
+	c, err := h.pick(name, target)
+	if err != nil {
+		return nil, err
+	}
+	return c.OpenStream(ctx, kind, target)
+}
+
+// ForwardTCP listens on listen, and forwards each connection accepted to
+// target("host:port") dialed by the peer of name, any peer if empty.
+func ForwardTCP(listen, target, peer string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	atom.Log.Infof("forward tcp %s to %s through peer %q", ln.Addr(), target, peer)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				atom.Log.Warnf("%s|accept failed: %v", ln.Addr(), err)
+				return
+			}
+			go forwardConn(conn, peer, StreamTCP, target)
+		}
+	}()
+	return ln, nil
+}
+
+// forwardConn opens a stream of kind to target through the peer of name, and
+// pipes conn with it.
+func forwardConn(conn net.Conn, name, kind, target string) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	s, err := Hub.OpenStream(ctx, name, kind, target)
+	cancel()
+	if err != nil {
+		atom.Log.Errorf("%s|open stream to %s failed: %v", conn.RemoteAddr(), target, err)
+		conn.Close()
+		return
+	}
+	atom.Log.Debugf("%v|%d|forward %s to %s", s.c.ID, s.id, conn.RemoteAddr(), target)
+	pipe(conn, s)
+}
+
+// handleTCPStream dials target if allowed for the peer, and pipes the stream
+// with the connection.
+func handleTCPStream(s *Stream, target string) error {
+	if err := allowTarget(s.c, target); err != nil {
+		return &tunnelError{code: errCodeRouteDenied, msg: err.Error()}
+	}
+	return dialStream(s, target)
+}
+
+// dialStream dials target, and pipes the stream with the connection.
+func dialStream(s *Stream, target string) error {
+	conn, err := net.DialTimeout("tcp", target, requestTimeout)
+	if err != nil {
+		return err
+	}
+	if err := s.Accept(); err != nil {
+		conn.Close()
+		return err
+	}
+	pipe(s, conn)
+	return nil
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies data between a and b in both directions until both are read
+// to EOF, then closes both. The writing side is half-closed once the other
+// side is read to EOF, and both are closed at once if either fails.
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err != nil {
+			atom.Log.Debugf("pipe %s to %s failed: %v", src.RemoteAddr(), dst.RemoteAddr(), err)
+			a.Close()
+			b.Close()
+			return
+		}
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	wg.Add(2)
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
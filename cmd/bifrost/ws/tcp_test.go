@@ -0,0 +1,94 @@
+package ws
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestAllowTarget(t *testing.T) {
+	SetTCPTargets(map[string][]string{"dc-west": {"db.internal:5432"}, "CN=dc-west,O=bifrost": {"example.com"}, "*": {"127.0.0.1:7"}})
+	defer SetTCPTargets(nil)
+	west := &Client{Name: "dc-west", Subject: "CN=dc-west,O=bifrost", CommonName: "dc-west"}
+	// presenting the name without the certificate
+	spoofer := &Client{Name: "dc-west"}
+	for _, tt := range []struct {
+		c      *Client
+		target string
+		ok     bool
+	}{
+		{c: west, target: "db.internal:5432", ok: true},
+		{c: west, target: "db.internal:22", ok: false},
+		{c: west, target: "example.com:443", ok: true},
+		{c: west, target: "127.0.0.1:7", ok: true},
+		{c: west, target: "example.com", ok: false},
+		{c: spoofer, target: "db.internal:5432", ok: false},
+		{c: spoofer, target: "127.0.0.1:7", ok: true},
+		{c: spoofer, target: "127.0.0.1:8", ok: false},
+	} {
+		if err := allowTarget(tt.c, tt.target); (err == nil) != tt.ok {
+			t.Errorf("allowTarget(%s, %s) error = %v, want ok %v", tt.c.Subject, tt.target, err, tt.ok)
+		}
+	}
+}
+
+func TestForwardTCP(t *testing.T) {
+	dialPair(t)
+	target := echoServer(t)
+	SetTCPTargets(map[string][]string{"*": {target, "127.0.0.1:1"}})
+	defer SetTCPTargets(nil)
+	ln, err := ForwardTCP("127.0.0.1:0", target, "")
+	if err != nil {
+		t.Fatalf("ForwardTCP() error = %v", err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	data := bytes.Repeat([]byte("tcp"), 300*1024)
+	go func() {
+		conn.Write(data)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("echoed %d bytes, want %d", len(got), len(data))
+	}
+
+	// target refused, the connection is closed at once
+	refused, err := ForwardTCP("127.0.0.1:0", "127.0.0.1:1", "")
+	if err != nil {
+		t.Fatalf("ForwardTCP() error = %v", err)
+	}
+	defer refused.Close()
+	conn2, err := net.Dial("tcp", refused.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn2.Close()
+	if n, err := conn2.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("Read() = %d, %v, want closed", n, err)
+	}
+
+	// target not allowed, the connection is closed at once too
+	denied, err := ForwardTCP("127.0.0.1:0", "127.0.0.1:2", "")
+	if err != nil {
+		t.Fatalf("ForwardTCP() error = %v", err)
+	}
+	defer denied.Close()
+	conn3, err := net.Dial("tcp", denied.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn3.Close()
+	if n, err := conn3.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("Read() = %d, %v, want closed", n, err)
+	}
+}
@@ -0,0 +1,120 @@
+package ws
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// peer certificate verification of the /ws endpoint, see RequirePeerCert.
+var (
+	peerCertRequired bool
+	allowedPeers     map[string]bool
+)
+
+// NewServerTLSConfig creates the TLS config of the listener serving wss. If
+// clientCAFile is not empty, client certificates are verified against it.
+//
+// NOTE: the listener also serves plain HTTP proxy requests, so a client
+// certificate is only verified if given, and ServeWS rejects peers without
+// one after RequirePeerCert is called. CONNECT requests are always rejected
+// without one.
+func NewServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// NewDialTLSConfig creates the TLS config used to dial a wss peer. If caFile
+// is empty, the system cert pool is used to verify the peer. If serverName is
+// not empty, it overrides the host name in the peer address when verifying.
+// If certFile is not empty, it is presented as client certificate.
+func NewDialTLSConfig(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// RequirePeerCert makes ServeWS reject peers without a verified client
+// certificate. If allowed is not empty, the certificate's common name or full
+// subject must also be one of them.
+func RequirePeerCert(allowed []string) {
+	peerCertRequired = true
+	allowedPeers = make(map[string]bool, len(allowed))
+	for _, subject := range allowed {
+		allowedPeers[subject] = true
+	}
+}
+
+// verifyPeer checks the client certificate of r, and returns the verified
+// subject and common name, which are empty if no certificate is verified.
+func verifyPeer(r *http.Request) (subject, commonName string, err error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		if peerCertRequired {
+			return "", "", fmt.Errorf("no verified client certificate")
+		}
+		return "", "", nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	subject, commonName = cert.Subject.String(), cert.Subject.CommonName
+	if len(allowedPeers) != 0 && !allowedPeers[subject] && !allowedPeers[commonName] {
+		return subject, commonName, fmt.Errorf("peer %s not allowed", subject)
+	}
+	return subject, commonName, nil
+}
+
+// verifyProxyClient checks the client certificate of r of method CONNECT,
+// which must be verified and allowed like peers, since it reaches the targets
+// allowed for this node by peers.
+func verifyProxyClient(r *http.Request) error {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return errors.New("no verified client certificate")
+	}
+	_, _, err := verifyPeer(r)
+	return err
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return pool, nil
+}
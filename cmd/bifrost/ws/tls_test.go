@@ -0,0 +1,150 @@
+package ws
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// genSelfSignedCert writes a self-signed certificate for 127.0.0.1 and
+// bifrost.test into dir, and returns the cert and key file paths.
+func genSelfSignedCert(t *testing.T, dir string) (string, string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bifrost.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"bifrost.test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey failed: %v", err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("write cert failed: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("write key failed: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestDialWSS(t *testing.T) {
+	certFile, keyFile := genSelfSignedCert(t, t.TempDir())
+
+	serverTLSConf, err := NewServerTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("NewServerTLSConfig failed: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(ServeWS))
+	srv.TLS = serverTLSConf
+	srv.StartTLS()
+	defer srv.Close()
+	addr := "wss://" + strings.TrimPrefix(srv.URL, "https://") + "/ws"
+
+	tests := []struct {
+		name       string
+		caFile     string
+		serverName string
+		wantErr    bool
+	}{
+		{name: "trusted CA", caFile: certFile, wantErr: false},
+		{name: "server name override", caFile: certFile, serverName: "bifrost.test", wantErr: false},
+		{name: "server name mismatch", caFile: certFile, serverName: "other.test", wantErr: true},
+		{name: "untrusted CA", caFile: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialTLSConf, err := NewDialTLSConfig("", "", tt.caFile, tt.serverName)
+			if err != nil {
+				t.Fatalf("NewDialTLSConfig failed: %v", err)
+			}
+			c, err := Dial(addr, dialTLSConf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Dial() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				c.conn.Close()
+			}
+		})
+	}
+}
+
+func TestDialMutualTLS(t *testing.T) {
+	certFile, keyFile := genSelfSignedCert(t, t.TempDir())
+	otherCertFile, otherKeyFile := genSelfSignedCert(t, t.TempDir())
+
+	serverTLSConf, err := NewServerTLSConfig(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatalf("NewServerTLSConfig failed: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(ServeWS))
+	srv.TLS = serverTLSConf
+	srv.StartTLS()
+	defer srv.Close()
+	defer func() {
+		peerCertRequired = false
+		allowedPeers = nil
+	}()
+	addr := "wss://" + strings.TrimPrefix(srv.URL, "https://") + "/ws"
+
+	tests := []struct {
+		name     string
+		certFile string
+		keyFile  string
+		allowed  []string
+		wantErr  bool
+	}{
+		{name: "verified peer", certFile: certFile, keyFile: keyFile, wantErr: false},
+		{name: "allowed peer", certFile: certFile, keyFile: keyFile, allowed: []string{"bifrost.test"}, wantErr: false},
+		{name: "peer not allowed", certFile: certFile, keyFile: keyFile, allowed: []string{"dc-east"}, wantErr: true},
+		{name: "no client cert", wantErr: true},
+		{name: "unknown CA", certFile: otherCertFile, keyFile: otherKeyFile, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			RequirePeerCert(tt.allowed)
+			dialTLSConf, err := NewDialTLSConfig(tt.certFile, tt.keyFile, certFile, "")
+			if err != nil {
+				t.Fatalf("NewDialTLSConfig failed: %v", err)
+			}
+			c, err := Dial(addr, dialTLSConf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Dial() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if c.Subject != "CN=bifrost.test" {
+					t.Errorf("Subject = %s, want CN=bifrost.test", c.Subject)
+				}
+				c.conn.Close()
+			}
+		})
+	}
+}
@@ -3,52 +3,137 @@ package packet
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 )
 
-// unique sequence id
-var uniqSeq uint32 
+// Version is the protocol version of packets sent, which is the second byte
+// of header. Version 1 is the header without Version, Flags and Codec,
+// version 2 compresses the replay counter with the payload, and version 3
+// seals payloads when written. Version 4 seals packets without payload too,
+// and confirms the session keys at login.
+const Version uint8 = 4
 
-// header defines all the fields of packet's header
+// MinVersion is the oldest protocol version of packets accepted.
+const MinVersion uint8 = 4
+
+// header defines all the fields of packet's header. Magic and Version are
+// kept in place across versions, so that incompatible peers are detected.
 type header struct {
-	Magic uint8      // magic number: 110
-	Type  PacketType // packet type
-	ID    uint64     // client id
-	Seq   uint32     // sequence
-	Code  int32      // error code
-	Size  uint32     // size(bytes) of payload
+	Magic   uint8      // magic number: 110
+	Version uint8      // protocol version
+	Type    PacketType // packet type
+	Flags   Flags      // flags of payload
+	Codec   uint8      // compression codec of payload
+	ID      uint64     // client id
+	Seq     uint32     // sequence
+	Code    int32      // error code
+	Size    uint32     // size(bytes) of payload
+}
+
+// HeaderSize is the size(bytes) of encoded header.
+var HeaderSize = binary.Size(header{})
+
+// Flags describe the payload of a packet.
+type Flags uint8
+
+const (
+	FlagCompressed    Flags = 1 << iota // payload is compressed by the codec in header
+	FlagEncrypted                       // payload is encrypted
+	FlagStreaming                       // packet is a part of a streamed body
+	FlagFinal                           // last packet of a streamed body
+	FlagMoreFragments                   // payload is split, and more fragments follow
+)
+
+// Capability bits are advertised when login, so that optional features are
+// used only if the peer supports them.
+type Capability uint32
+
+const (
+	CapStreaming   Capability = 1 << iota // chunked request and response bodies
+	CapCancel                             // cancel packets
+	CapCodecs                             // codec negotiation
+	CapNotice                             // notices as control messages
+	CapFragment                           // fragmentation of oversized packets
+	CapBatch                              // multiple packets in a websocket message
+	CapFlowControl                        // credit-based flow control of body chunks
+	CapStream                             // multiplexed streams
+)
+
+// Capabilities supported by this version.
+const Capabilities = CapStreaming | CapCancel | CapCodecs | CapNotice | CapFragment | CapBatch | CapFlowControl | CapStream
+
+// ErrMagic is returned by Decode if the magic number mismatches.
+var ErrMagic = errors.New("bad magic number")
+
+// ErrSize is returned by Decode if the payload size in header exceeds the
+// bytes left in the message.
+var ErrSize = errors.New("payload size exceeds message")
+
+// VersionError is returned by Decode if the protocol version of packet is not
+// supported, which is probably sent by an incompatible peer.
+type VersionError struct {
+	Version uint8
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("incompatible protocol version %d, supported %d-%d", e.Version, MinVersion, Version)
+}
+
+// CheckVersion returns a *VersionError if version is not supported.
+func CheckVersion(version uint8) error {
+	if version < MinVersion || version > Version {
+		return &VersionError{Version: version}
+	}
+	return nil
 }
 
 type PacketType uint8
 
+// A request or response is streamed as a header packet, followed by zero or
+// more body chunk packets and an end-of-stream packet, all with the same seq.
 const (
-	PacketTypeRequest PacketType = iota
-	PacketTypeResponse
+	PacketTypeRequest  PacketType = iota // request line and headers
+	PacketTypeResponse                   // status line and headers
 	PacketTypeNotice
+	PacketTypeRequestBody  // chunk of request body
+	PacketTypeResponseBody // chunk of response body
+	PacketTypeRequestEnd   // end of request body
+	PacketTypeResponseEnd  // end of response body
+	PacketTypeLogin        // login handshake right after websocket connected
+	PacketTypeCancel       // cancel the request of seq
+	PacketTypeWindow       // credit granted to send body chunks of seq
+	PacketTypeStreamOpen   // open the stream of seq, or accept it if sent back
+	PacketTypeStreamData   // data of the stream of seq
+	PacketTypeStreamClose  // no more data of the stream of seq from the sender
+	PacketTypeStreamReset  // abort the stream of seq with the error code in header
 )
 
 const DefaultMagicNumber uint8 = 110
 
 // Packet is the holder of structured message.
 type Packet struct {
-	Header header
-	Payload   []byte // NUL-padded string
+	Header  header
+	Payload []byte // NUL-padded string
 }
 
 func NewPacket() *Packet {
 	return new(Packet)
 }
 
-func NewRequestPacket(payload []byte) *Packet {
+// NewSeqPacket creates a packet of typ which belongs to the request of seq.
+func NewSeqPacket(typ PacketType, seq uint32, payload []byte) *Packet {
 	return &Packet{
 		Header: header{
-			Magic: DefaultMagicNumber,
-			Type: PacketTypeRequest,
-			ID: 0,
-			Seq: GenUniqSeq(),
-			Code: 0,
-			Size: uint32(len(payload)),
+			Magic:   DefaultMagicNumber,
+			Version: Version,
+			Type:    typ,
+			ID:      0,
+			Seq:     seq,
+			Code:    0,
+			Size:    uint32(len(payload)),
 		},
 		Payload: payload,
 	}
@@ -64,24 +149,63 @@ func Parse(message []byte) (*Packet, error) {
 	return Decode(buf)
 }
 
-// Decode reads a packet from reader.
+// ParseAll parses all packets laid out back to back in message.
+func ParseAll(message []byte) ([]*Packet, error) {
+	buf := bytes.NewReader(message)
+	var pkts []*Packet
+	for buf.Len() > 0 {
+		pkt, err := Decode(buf)
+		if err != nil {
+			return pkts, err
+		}
+		pkts = append(pkts, pkt)
+	}
+	return pkts, nil
+}
+
+// Decode reads a packet from reader. The magic number and version are checked
+// before the rest of header, whose layout may differ across versions. The
+// payload size in header is told by the peer, so it is checked against the
+// bytes left before allocated if reader tells its length, e.g.: bytes.Reader,
+// and the payload is read as it arrives otherwise.
 func Decode(r io.Reader) (*Packet, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != DefaultMagicNumber {
+		return nil, ErrMagic
+	}
+	if err := CheckVersion(prefix[1]); err != nil {
+		return nil, err
+	}
 	pkt := &Packet{}
-	if err := binary.Read(r, binary.BigEndian, &pkt.Header); err != nil {
+	if err := binary.Read(io.MultiReader(bytes.NewReader(prefix[:]), r), binary.BigEndian, &pkt.Header); err != nil {
 		return nil, err
 	}
 
-	// Reuse the Data slice, if possible
-	if cap(pkt.Payload) >= int(pkt.Header.Size) {
-		pkt.Payload = pkt.Payload[:pkt.Header.Size]
-	} else {
-		pkt.Payload = make([]byte, pkt.Header.Size)
+	size := int64(pkt.Header.Size)
+	if size == 0 {
+		return pkt, nil
 	}
-
-	if _, err := io.ReadFull(r, pkt.Payload); err != nil {
+	if lr, ok := r.(interface{ Len() int }); ok {
+		if size > int64(lr.Len()) {
+			return nil, ErrSize
+		}
+		pkt.Payload = make([]byte, size)
+		if _, err := io.ReadFull(r, pkt.Payload); err != nil {
+			return nil, err
+		}
+		return pkt, nil
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(r, size))
+	if err != nil {
 		return nil, err
 	}
-
+	if int64(len(payload)) != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	pkt.Payload = payload
 	return pkt, nil
 }
 
@@ -103,9 +227,3 @@ func Encode(pkt *Packet) ([]byte, error) {
 
 	return buf.Bytes(), nil
 }
-
-// GenUniqSeq generate a new unique sequence id
-func GenUniqSeq() uint32 {
-	uniqSeq += 1
-	return uniqSeq
-}
@@ -0,0 +1,86 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	pkt := NewSeqPacket(PacketTypeRequestBody, 7, []byte("chunk"))
+	pkt.Header.Flags = FlagStreaming
+	buf, err := Encode(pkt)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	got, err := Parse(buf)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, pkt) {
+		t.Errorf("Parse() = %+v, want %+v", got, pkt)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		prefix  []byte
+		wantErr error
+	}{
+		{name: "bad magic", prefix: []byte{0, Version}, wantErr: ErrMagic},
+		{name: "version 1", prefix: []byte{DefaultMagicNumber, 1}, wantErr: &VersionError{Version: 1}},
+		{name: "newer version", prefix: []byte{DefaultMagicNumber, Version + 1}, wantErr: &VersionError{Version: Version + 1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := append(append([]byte{}, tt.prefix...), buf[2:]...)
+			if _, err := Parse(msg); !reflect.DeepEqual(err, tt.wantErr) {
+				t.Errorf("Parse() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeSize(t *testing.T) {
+	pkt := NewSeqPacket(PacketTypeLogin, 0, []byte("login"))
+	buf, err := Encode(pkt)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	// a size far larger than the message is rejected before allocated
+	binary.BigEndian.PutUint32(buf[HeaderSize-4:], 0xF0000000)
+	if _, err := Parse(buf); err != ErrSize {
+		t.Errorf("Parse() error = %v, want %v", err, ErrSize)
+	}
+	// the payload of other readers is read as it arrives
+	if _, err := Decode(io.MultiReader(bytes.NewReader(buf))); err != io.ErrUnexpectedEOF {
+		t.Errorf("Decode() error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	var msg []byte
+	var want []*Packet
+	for i, payload := range [][]byte{[]byte("head"), nil, []byte("chunk")} {
+		pkt := NewSeqPacket(PacketTypeResponseBody, uint32(i+1), payload)
+		buf, err := Encode(pkt)
+		if err != nil {
+			t.Fatalf("Encode() error = %v", err)
+		}
+		msg = append(msg, buf...)
+		want = append(want, pkt)
+	}
+	got, err := ParseAll(msg)
+	if err != nil {
+		t.Fatalf("ParseAll() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseAll() = %+v, want %+v", got, want)
+	}
+
+	// a truncated packet fails after the whole ones
+	got, err = ParseAll(msg[:len(msg)-1])
+	if err == nil || len(got) != 2 {
+		t.Errorf("ParseAll() of truncated = %d packets, error = %v", len(got), err)
+	}
+}